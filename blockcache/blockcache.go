@@ -0,0 +1,225 @@
+package blockcache
+
+import (
+	"container/list"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/morrocker/errors"
+	"github.com/morrocker/log"
+	"github.com/morrocker/utils"
+)
+
+// Shared is the cache used by every recovery. It is nil while the cache is disabled
+var Shared *Cache
+
+// Cache is an on disk, content addressed block store that evicts the least recently used blocks once
+// it grows over its size limit. Blocks are stored as dir/<first two hash chars>/<hash>
+type Cache struct {
+	lock   sync.Mutex
+	dir    string
+	limit  int64
+	size   int64
+	items  map[string]*list.Element
+	lru    *list.List
+	hits   int64
+	misses int64
+}
+
+type entry struct {
+	hash string
+	size int64
+}
+
+// Stats describes the cache usage since the server started
+type Stats struct {
+	Dir     string  `json:"dir"`
+	Limit   int64   `json:"limit"`
+	Size    int64   `json:"size"`
+	Blocks  int     `json:"blocks"`
+	Hits    int64   `json:"hits"`
+	Misses  int64   `json:"misses"`
+	HitRate float64 `json:"hitRate"`
+}
+
+// Open indexes the blocks already stored on dir, oldest first, and trims them to limit bytes
+func Open(dir string, limit int64) (*Cache, error) {
+	op := "blockcache.Open()"
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, errors.New(op, err)
+	}
+	c := &Cache{
+		dir:   dir,
+		limit: limit,
+		items: make(map[string]*list.Element),
+		lru:   list.New(),
+	}
+
+	type found struct {
+		hash  string
+		size  int64
+		mtime time.Time
+	}
+	var blocks []found
+	err := filepath.Walk(dir, func(p string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return nil
+		}
+		if strings.HasSuffix(p, ".tmp") {
+			os.Remove(p)
+			return nil
+		}
+		blocks = append(blocks, found{hash: info.Name(), size: info.Size(), mtime: info.ModTime()})
+		return nil
+	})
+	if err != nil {
+		return nil, errors.New(op, err)
+	}
+	sort.Slice(blocks, func(i, j int) bool { return blocks[i].mtime.Before(blocks[j].mtime) })
+	for _, b := range blocks {
+		c.items[b.hash] = c.lru.PushFront(&entry{hash: b.hash, size: b.size})
+		c.size += b.size
+	}
+	c.lock.Lock()
+	c.evict()
+	c.lock.Unlock()
+	log.Info("Block cache on %s holds %d blocks (%s of %s)", dir, len(c.items), utils.B2H(c.size), utils.B2H(limit))
+	return c, nil
+}
+
+func (c *Cache) blockPath(hash string) string {
+	if len(hash) < 2 {
+		return path.Join(c.dir, "_", hash)
+	}
+	return path.Join(c.dir, hash[:2], hash)
+}
+
+// Get returns the cached content of a block. ok is false if the block is not on the cache
+func (c *Cache) Get(hash string) (content []byte, ok bool) {
+	c.lock.Lock()
+	el, ok := c.items[hash]
+	if !ok {
+		c.misses++
+		c.lock.Unlock()
+		return nil, false
+	}
+	c.lru.MoveToFront(el)
+	c.lock.Unlock()
+
+	p := c.blockPath(hash)
+	content, err := ioutil.ReadFile(p)
+	if err != nil {
+		c.Remove(hash)
+		c.lock.Lock()
+		c.misses++
+		c.lock.Unlock()
+		return nil, false
+	}
+	now := time.Now()
+	os.Chtimes(p, now, now)
+	c.lock.Lock()
+	c.hits++
+	c.lock.Unlock()
+	return content, true
+}
+
+// Put stores a block on the cache, evicting the least recently used ones if needed. Blocks bigger than
+// the whole cache are ignored
+func (c *Cache) Put(hash string, content []byte) error {
+	op := "blockcache.Put()"
+	size := int64(len(content))
+	if size > c.limit {
+		return nil
+	}
+	c.lock.Lock()
+	_, ok := c.items[hash]
+	c.lock.Unlock()
+	if ok {
+		return nil
+	}
+
+	p := c.blockPath(hash)
+	if err := os.MkdirAll(path.Dir(p), 0700); err != nil {
+		return errors.New(op, err)
+	}
+	tmp, err := ioutil.TempFile(path.Dir(p), hash+".*.tmp")
+	if err != nil {
+		return errors.New(op, err)
+	}
+	if _, err := tmp.Write(content); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return errors.New(op, err)
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return errors.New(op, err)
+	}
+	if err := os.Rename(tmp.Name(), p); err != nil {
+		os.Remove(tmp.Name())
+		return errors.New(op, err)
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if _, ok := c.items[hash]; ok {
+		return nil
+	}
+	c.items[hash] = c.lru.PushFront(&entry{hash: hash, size: size})
+	c.size += size
+	c.evict()
+	return nil
+}
+
+// Remove deletes a block from the cache, usually because its content turned out to be invalid
+func (c *Cache) Remove(hash string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if el, ok := c.items[hash]; ok {
+		c.remove(el)
+	}
+}
+
+// Stats returns the cache size and hit rate
+func (c *Cache) Stats() Stats {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	s := Stats{
+		Dir:    c.dir,
+		Limit:  c.limit,
+		Size:   c.size,
+		Blocks: len(c.items),
+		Hits:   c.hits,
+		Misses: c.misses,
+	}
+	if lookups := c.hits + c.misses; lookups > 0 {
+		s.HitRate = float64(c.hits) / float64(lookups)
+	}
+	return s
+}
+
+// evict must be called holding lock
+func (c *Cache) evict() {
+	for c.size > c.limit {
+		el := c.lru.Back()
+		if el == nil {
+			return
+		}
+		c.remove(el)
+	}
+}
+
+// remove must be called holding lock
+func (c *Cache) remove(el *list.Element) {
+	e := el.Value.(*entry)
+	c.lru.Remove(el)
+	delete(c.items, e.hash)
+	c.size -= e.size
+	os.Remove(c.blockPath(e.hash))
+}
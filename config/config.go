@@ -8,18 +8,41 @@ type Config struct {
 	RootLogDir          string
 	SrvLogDir           string
 	RcvrLogDir          string
+	JournalDir          string
+	TreeCacheDir        string
+	TreeCacheMaxAge     int
+	StagingDir          string
+	BlockCacheDir       string
+	BlockCacheSize      int64
+	SecretsFile         string
+	SecretsKey          string
+	OutputFileMode      string
+	OutputDirMode       string
+	MissingBlockPolicy  string
 	LoginAddr           string
 	HostAddr            string
 	RecoveriesJSON      string
+	HistoryJSON         string
 	MountRoot           string
 	MetafileWorkers     int
 	FileWorkers         int
 	BlockWorkers        int
 	MetafilesBuffSize   int
 	BlocksBuffer        int
+	RecoverySlots       int
 	Clouds              map[string]Cloud
 	SlackToken          string
 	SlackChannel        string
+	APITokens           []APIToken
+	UsersFile           string
+	AllowedOrigins      []string
+	ShutdownTimeout     int
+	UnmountOnShutdown   bool
+	BandwidthLimit      int64
+	BandwidthSchedule   []BandwidthWindow
+	BandwidthJSON       string
+	StoreFailures       int
+	StoreCooldown       int
 }
 
 // Cloud stores the keys, address and number of storages from which to restrieve data
@@ -28,6 +51,29 @@ type Cloud struct {
 	FilesAddress string
 	Stores       []BlocksMaster
 	Legacy       bool
+	BlockHash    string
+	Slots        int
+	// Hedge races a slow block request against another store once it takes longer than HedgePercentile
+	// of the store latencies. HedgeMaxRatio caps hedged requests as a fraction of the block requests
+	Hedge           bool
+	HedgePercentile float64
+	HedgeMaxRatio   float64
+}
+
+// APIToken grants a role to any request carrying its token
+type APIToken struct {
+	Name  string
+	Token string
+	Role  string
+}
+
+// BandwidthWindow sets the global block download limit, in bytes per second, between two times of the
+// day written as "15:04". Windows where From is after To wrap around midnight. A zero Limit means unlimited.
+// {"From":"09:00","To":"19:00","Limit":20000000} caps downloads to 20 MB/s during office hours
+type BandwidthWindow struct {
+	From  string
+	To    string
+	Limit int64
 }
 
 //BlocksMaster stores the address and magic to use for each store
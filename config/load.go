@@ -66,6 +66,56 @@ func SetLogger() {
 	log.ToggleDualMode()
 }
 
+func CreateJournalDir() {
+	if Data.JournalDir == "" {
+		Data.JournalDir = path.Join(Data.RootLogDir, "journals")
+	}
+	if err := os.MkdirAll(Data.JournalDir, 0700); err != nil {
+		log.Error("config.CreateJournalDir()", err)
+		os.Exit(1)
+	}
+}
+
+func CreateTreeCacheDir() {
+	if Data.TreeCacheDir == "" {
+		Data.TreeCacheDir = path.Join(Data.RootLogDir, "cache", "trees")
+	}
+	if err := os.MkdirAll(Data.TreeCacheDir, 0700); err != nil {
+		log.Error("config.CreateTreeCacheDir()", err)
+		os.Exit(1)
+	}
+}
+
+// CreateStagingDir creates the directory where archive recoveries stage their files. Staged files hold
+// plain content, so it must be on server local storage, never on a delivery disk
+func CreateStagingDir() {
+	if Data.StagingDir == "" {
+		Data.StagingDir = path.Join(Data.RootLogDir, "staging")
+	}
+	if err := os.MkdirAll(Data.StagingDir, 0700); err != nil {
+		log.Error("config.CreateStagingDir()", err)
+		os.Exit(1)
+	}
+}
+
+// SetBlockCacheDir sets the default block cache location. The cache itself is opened by the director
+func SetBlockCacheDir() {
+	if Data.BlockCacheDir == "" {
+		Data.BlockCacheDir = path.Join(Data.RootLogDir, "cache", "blocks")
+	}
+}
+
+// SetSecrets sets the default secrets file location. The master key is taken from the
+// RECOVERYSERVER_SECRETS_KEY environment variable when set, so it can be kept out of the config file
+func SetSecrets() {
+	if Data.SecretsFile == "" {
+		Data.SecretsFile = path.Join(Data.RootLogDir, "secrets.json")
+	}
+	if key := os.Getenv("RECOVERYSERVER_SECRETS_KEY"); key != "" {
+		Data.SecretsKey = key
+	}
+}
+
 func CreatePDFDir() {
 	if err := os.MkdirAll(Data.DeliveryDir, 0700); err != nil {
 		log.Error("config.CreatePDFDir()", err)
@@ -0,0 +1,190 @@
+package director
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"time"
+
+	"github.com/morrocker/errors"
+	"github.com/morrocker/log"
+	"github.com/morrocker/recoveryserver/config"
+	"github.com/morrocker/recoveryserver/throttle"
+	"github.com/morrocker/utils"
+)
+
+// Bandwidth describes the global block download limit, in bytes per second, and the time of day windows
+// that override it. Current is the limit being applied right now
+type Bandwidth struct {
+	Limit    int64                    `json:"limit"`
+	Schedule []config.BandwidthWindow `json:"schedule"`
+	Current  int64                    `json:"current"`
+}
+
+// bandwidthScheduler applies the global bandwidth limit matching the time of day every minute
+func (d *Director) bandwidthScheduler() {
+	log.TaskV("Starting Bandwidth Scheduler")
+	for {
+		d.applyBandwidth()
+		time.Sleep(time.Minute)
+	}
+}
+
+// applyBandwidth sets the global limiter rate to the limit of the window matching the current time
+func (d *Director) applyBandwidth() {
+	d.bandwidthLock.Lock()
+	limit := currentLimit(d.bandwidth.Limit, d.bandwidth.Schedule, time.Now())
+	d.bandwidthLock.Unlock()
+	if throttle.Global.Rate() == limit {
+		return
+	}
+	throttle.Global.SetRate(limit)
+	if limit == 0 {
+		log.Info("Global bandwidth limit removed")
+		return
+	}
+	log.Info("Global bandwidth limit set to %sps", utils.B2H(limit))
+}
+
+// Bandwidth returns the global bandwidth settings
+func (d *Director) Bandwidth() Bandwidth {
+	d.bandwidthLock.Lock()
+	defer d.bandwidthLock.Unlock()
+	return Bandwidth{
+		Limit:    d.bandwidth.Limit,
+		Schedule: append([]config.BandwidthWindow{}, d.bandwidth.Schedule...),
+		Current:  throttle.Global.Rate(),
+	}
+}
+
+// SetBandwidth replaces the global bandwidth limit and schedule and applies them right away. A nil
+// schedule keeps the current one
+func (d *Director) SetBandwidth(limit int64, schedule []config.BandwidthWindow) error {
+	op := "director.SetBandwidth()"
+	if limit < 0 {
+		return errors.New(op, "Bandwidth limit can't be negative")
+	}
+	if err := checkSchedule(schedule); err != nil {
+		return errors.Extend(op, err)
+	}
+	d.bandwidthLock.Lock()
+	d.bandwidth.Limit = limit
+	if schedule != nil {
+		d.bandwidth.Schedule = schedule
+	}
+	err := d.saveBandwidth()
+	d.bandwidthLock.Unlock()
+	d.applyBandwidth()
+	if err != nil {
+		return errors.Extend(op, err)
+	}
+	return nil
+}
+
+// saveBandwidth writes the global bandwidth settings to BandwidthJSON, so changes made while running
+// survive a restart. It must be called holding bandwidthLock
+func (d *Director) saveBandwidth() error {
+	if config.Data.BandwidthJSON == "" {
+		return nil
+	}
+	data, err := json.MarshalIndent(Bandwidth{Limit: d.bandwidth.Limit, Schedule: d.bandwidth.Schedule}, "", "  ")
+	if err != nil {
+		return errors.New("director.saveBandwidth()", err)
+	}
+	if err := writeFile(config.Data.BandwidthJSON, data); err != nil {
+		return errors.Extend("director.saveBandwidth()", err)
+	}
+	return nil
+}
+
+// loadBandwidth reads the global bandwidth settings saved on BandwidthJSON. They take precedence over
+// the ones on the configuration file
+func (d *Director) loadBandwidth() error {
+	op := "director.loadBandwidth()"
+	if config.Data.BandwidthJSON == "" {
+		return nil
+	}
+	jsonBytes, err := ioutil.ReadFile(config.Data.BandwidthJSON)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return errors.New(op, err)
+	}
+	var saved Bandwidth
+	if err := json.Unmarshal(jsonBytes, &saved); err != nil {
+		return errors.New(op, err)
+	}
+	if saved.Limit < 0 {
+		return errors.New(op, "Bandwidth limit can't be negative")
+	}
+	if err := checkSchedule(saved.Schedule); err != nil {
+		return errors.Extend(op, err)
+	}
+	d.bandwidthLock.Lock()
+	defer d.bandwidthLock.Unlock()
+	d.bandwidth.Limit = saved.Limit
+	d.bandwidth.Schedule = saved.Schedule
+	log.Info("Loaded bandwidth settings from %s", config.Data.BandwidthJSON)
+	return nil
+}
+
+// SetRecoveryBandwidth caps a given recovery block downloads in bytes per second. Zero removes the limit
+func (d *Director) SetRecoveryBandwidth(id int, limit int64) error {
+	op := "director.SetRecoveryBandwidth()"
+	r, err := d.findRecovery(id)
+	if err != nil {
+		return errors.Extend(op, err)
+	}
+	if err := r.SetBandwidthLimit(limit); err != nil {
+		return errors.Extend(op, err)
+	}
+	return nil
+}
+
+// currentLimit returns the limit of the first window containing t, or limit if none does
+func currentLimit(limit int64, schedule []config.BandwidthWindow, t time.Time) int64 {
+	now := t.Hour()*60 + t.Minute()
+	for _, w := range schedule {
+		from, err := minuteOfDay(w.From)
+		if err != nil {
+			continue
+		}
+		to, err := minuteOfDay(w.To)
+		if err != nil {
+			continue
+		}
+		if from <= to && now >= from && now < to {
+			return w.Limit
+		}
+		if from > to && (now >= from || now < to) {
+			return w.Limit
+		}
+	}
+	return limit
+}
+
+func checkSchedule(schedule []config.BandwidthWindow) error {
+	op := "director.checkSchedule()"
+	for _, w := range schedule {
+		if w.Limit < 0 {
+			return errors.New(op, fmt.Sprintf("Window %s-%s has a negative limit", w.From, w.To))
+		}
+		if _, err := minuteOfDay(w.From); err != nil {
+			return errors.Extend(op, err)
+		}
+		if _, err := minuteOfDay(w.To); err != nil {
+			return errors.Extend(op, err)
+		}
+	}
+	return nil
+}
+
+// minuteOfDay parses a "15:04" time of the day into minutes since midnight
+func minuteOfDay(s string) (int, error) {
+	t, err := time.Parse("15:04", s)
+	if err != nil {
+		return 0, errors.New("director.minuteOfDay()", fmt.Sprintf("Invalid time of the day %q, expected HH:MM", s))
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
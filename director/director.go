@@ -1,13 +1,18 @@
 package director
 
 import (
+	"sort"
+	"sync"
+
 	"github.com/morrocker/broadcast"
 	"github.com/morrocker/errors"
 	"github.com/morrocker/log"
+	"github.com/morrocker/recoveryserver/blockcache"
 	"github.com/morrocker/recoveryserver/config"
 	"github.com/morrocker/recoveryserver/disks"
 	"github.com/morrocker/recoveryserver/pdf"
 	"github.com/morrocker/recoveryserver/recovery"
+	"github.com/morrocker/recoveryserver/secrets"
 )
 
 // Director orders and decides which recoveries should be executed next
@@ -17,18 +22,38 @@ type Director struct {
 	broadcaster *broadcast.Broadcaster
 	Recoveries  map[int]*recovery.Recovery
 	devices     map[string]disks.Device
+	history     []HistoryRecord
+	lock        sync.Mutex
+	historyLock sync.Mutex
+
+	bandwidth     Bandwidth
+	bandwidthLock sync.Mutex
+
+	done         chan struct{}
+	shutdownOnce sync.Once
 }
 
 // StartDirector starts the Director service and all subservices
 func (d *Director) StartDirector() error {
 	log.Task("Starting Director Services")
-	ec := make(chan error)
 
 	d.init()
+	if err := d.loadRecoveries(); err != nil {
+		log.Errorln(errors.Extend("director.StartDirector()", err))
+	}
+	if err := d.loadHistory(); err != nil {
+		log.Errorln(errors.Extend("director.StartDirector()", err))
+	}
+	if err := d.loadBandwidth(); err != nil {
+		log.Errorln(errors.Extend("director.StartDirector()", err))
+	}
+	go d.recoveriesKeeper()
+	go d.metricsUpdater()
 	go d.devicesScanner()
 	go d.recoveryPicker()
-	<-ec
-	log.Info("Shutting down director")
+	go d.bandwidthScheduler()
+	<-d.done
+	log.Info("Director shut down")
 	return nil
 }
 
@@ -37,6 +62,91 @@ func (d *Director) init() {
 	d.devices = make(map[string]disks.Device)
 	d.Recoveries = make(map[int]*recovery.Recovery)
 	d.broadcaster = broadcast.New()
+	d.done = make(chan struct{})
+	if err := checkSchedule(config.Data.BandwidthSchedule); err != nil {
+		log.Errorln(errors.Extend("director.init()", err))
+	}
+	if config.Data.BlockCacheSize > 0 {
+		cache, err := blockcache.Open(config.Data.BlockCacheDir, config.Data.BlockCacheSize)
+		if err != nil {
+			log.Errorln(errors.Extend("director.init()", err))
+		}
+		blockcache.Shared = cache
+	}
+	if err := recovery.CheckOutputModes(); err != nil {
+		log.Errorln(errors.Extend("director.init()", err))
+	}
+	if err := recovery.CheckMissingBlockPolicy(); err != nil {
+		log.Errorln(errors.Extend("director.init()", err))
+	}
+	if config.Data.SecretsKey != "" {
+		store, err := secrets.Open(config.Data.SecretsFile, config.Data.SecretsKey)
+		if err != nil {
+			log.Errorln(errors.Extend("director.init()", err))
+		}
+		secrets.Shared = store
+	} else {
+		log.InfoV("SecretsKey is not set. Encrypted output is disabled")
+	}
+	d.bandwidth.Limit = config.Data.BandwidthLimit
+	d.bandwidth.Schedule = config.Data.BandwidthSchedule
+}
+
+// Listen returns a listener that is notified every time a recovery changes its state, step or settings
+func (d *Director) Listen() *broadcast.Listener {
+	return d.broadcaster.Listen()
+}
+
+// Progress returns a progress snapshot for every recovery
+func (d *Director) Progress() []recovery.Progress {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	var out []recovery.Progress
+	for _, r := range d.Recoveries {
+		out = append(out, r.Progress())
+	}
+	return out
+}
+
+// RecoveriesJSON returns the recoveries registry as JSON, the same way it is saved to RecoveriesJSON
+func (d *Director) RecoveriesJSON() ([]byte, error) {
+	data, err := d.marshalRecoveries()
+	if err != nil {
+		return nil, errors.Extend("director.RecoveriesJSON()", err)
+	}
+	return data, nil
+}
+
+// RecoveriesDetail returns the settings and full progress of every recovery, sorted by ID
+func (d *Director) RecoveriesDetail() []recovery.Detail {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	out := []recovery.Detail{}
+	for _, r := range d.Recoveries {
+		out = append(out, r.Detail())
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].ID < out[j].ID })
+	return out
+}
+
+// HasRecovery returns true if a recovery with the given id exists
+func (d *Director) HasRecovery(id int) bool {
+	_, err := d.findRecovery(id)
+	return err == nil
+}
+
+// RecoveryDetail returns the settings and full progress of a given recovery
+func (d *Director) RecoveryDetail(id int) (recovery.Detail, error) {
+	r, err := d.findRecovery(id)
+	if err != nil {
+		return recovery.Detail{}, errors.Extend("director.RecoveryDetail()", err)
+	}
+	return r.Detail(), nil
+}
+
+// Stores returns the health of every store used by the recoveries so far
+func (d *Director) Stores() []recovery.StoreStats {
+	return recovery.StoresHealth()
 }
 
 // Stop sets Run to false
@@ -7,6 +7,7 @@ import (
 	"github.com/morrocker/errors"
 	"github.com/morrocker/log"
 	"github.com/morrocker/recoveryserver/disks"
+	"github.com/morrocker/recoveryserver/metrics"
 )
 
 func (d *Director) Devices() (map[string]disks.Device, error) {
@@ -30,10 +31,31 @@ func (d *Director) devicesScanner() {
 		}
 		d.devices = devs
 		previous = devs
+		updateDevicesMetrics(devs)
 		time.Sleep(time.Second)
 	}
 }
 
+func updateDevicesMetrics(devs map[string]disks.Device) {
+	var mounted int
+	for _, dev := range devs {
+		for _, p := range dev.DevData.Partitions {
+			if p.MountPoint != "" {
+				mounted++
+				break
+			}
+		}
+	}
+	metrics.Devices.Set(float64(len(devs)))
+	metrics.MountedDevices.Set(float64(mounted))
+}
+
+// HasDevice returns true if a device with the given serial was found by the devices scanner
+func (d *Director) HasDevice(serial string) bool {
+	_, ok := d.devices[serial]
+	return ok
+}
+
 func (d *Director) MountDisk(serial string) error {
 	if err := d.devices[serial].Mount(); err != nil {
 		return errors.Extend("director.MountDisk()", err)
@@ -0,0 +1,199 @@
+package director
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"time"
+
+	"github.com/morrocker/errors"
+	"github.com/morrocker/log"
+	"github.com/morrocker/recoveryserver/config"
+	"github.com/morrocker/recoveryserver/recovery"
+)
+
+// HistoryRecord stores a finished recovery moved out of the Recoveries registry
+type HistoryRecord struct {
+	Recovery   recovery.Detail `json:"recovery"`
+	ArchivedAt time.Time       `json:"archivedAt"`
+	Purged     bool            `json:"purged"`
+}
+
+// RemoveRecovery deletes a recovery from the registry. If purge is set its output, logs and journal are
+// deleted too. Running or Paused recoveries must be canceled first
+func (d *Director) RemoveRecovery(id int, purge bool) error {
+	log.TaskV("Removing recovery #%d", id)
+	if err := d.removeRecovery(id, purge, (*recovery.Recovery).CanRemove); err != nil {
+		return errors.Extend("director.RemoveRecovery()", err)
+	}
+	return nil
+}
+
+// removeRecovery deletes a recovery from the registry if check allows it. The check and the delete are done
+// holding the lock, so the recovery can't be picked to run in between. It is purged once out of the
+// registry, and put back if the purge fails
+func (d *Director) removeRecovery(id int, purge bool, check func(*recovery.Recovery) error) error {
+	op := "director.removeRecovery()"
+	d.lock.Lock()
+	r, ok := d.Recoveries[id]
+	if !ok {
+		d.lock.Unlock()
+		return errors.New(op, fmt.Sprintf("Recovery %d not found", id))
+	}
+	if err := check(r); err != nil {
+		d.lock.Unlock()
+		return errors.Extend(op, err)
+	}
+	if purge {
+		if err := d.checkSharedOutput(r); err != nil {
+			d.lock.Unlock()
+			return errors.Extend(op, err)
+		}
+	}
+	delete(d.Recoveries, id)
+	d.lock.Unlock()
+
+	if purge {
+		if err := r.Purge(); err != nil {
+			d.lock.Lock()
+			d.Recoveries[id] = r
+			d.lock.Unlock()
+			return errors.Extend(op, err)
+		}
+	}
+	d.broadcaster.Broadcast()
+	return nil
+}
+
+// ArchiveRecovery moves a Done or Canceled recovery into the history store
+func (d *Director) ArchiveRecovery(id int, purge bool) error {
+	log.TaskV("Archiving recovery #%d", id)
+	op := "director.ArchiveRecovery()"
+	r, err := d.findRecovery(id)
+	if err != nil {
+		return errors.Extend(op, err)
+	}
+	finished := func(r *recovery.Recovery) error {
+		if !r.IsFinished() {
+			return errors.New(op, fmt.Sprintf("Recovery #%d must be Done or Canceled to be archived", id))
+		}
+		return nil
+	}
+	if err := finished(r); err != nil {
+		return err
+	}
+	if purge {
+		d.lock.Lock()
+		err := d.checkSharedOutput(r)
+		d.lock.Unlock()
+		if err != nil {
+			return errors.Extend(op, err)
+		}
+	}
+	record := HistoryRecord{
+		Recovery:   r.Detail(),
+		ArchivedAt: time.Now(),
+		Purged:     purge,
+	}
+
+	// The record is saved before the recovery is removed so a failed save never loses it
+	d.historyLock.Lock()
+	d.history = append(d.history, record)
+	if err := d.saveHistory(); err != nil {
+		d.history = d.history[:len(d.history)-1]
+		d.historyLock.Unlock()
+		return errors.Extend(op, err)
+	}
+	d.historyLock.Unlock()
+
+	// Checked again on removal, as a retry may have queued it since
+	if err := d.removeRecovery(id, purge, finished); err != nil {
+		d.historyLock.Lock()
+		defer d.historyLock.Unlock()
+		for i := len(d.history) - 1; i >= 0; i-- {
+			if d.history[i].Recovery.ID == id {
+				d.history = append(d.history[:i], d.history[i+1:]...)
+				break
+			}
+		}
+		if err := d.saveHistory(); err != nil {
+			log.Errorln(errors.Extend(op, err))
+		}
+		return errors.Extend(op, err)
+	}
+	return nil
+}
+
+// checkSharedOutput returns an error if another recovery, active or archived without purge, writes to the
+// same output as r. Purging r would delete that output too. Must be called holding lock
+func (d *Director) checkSharedOutput(r *recovery.Recovery) error {
+	op := "director.checkSharedOutput()"
+	out := r.OutputPath()
+	if out == "" {
+		return nil
+	}
+	for id, other := range d.Recoveries {
+		if id != r.Data.ID && other.OutputPath() == out {
+			return errors.New(op, fmt.Sprintf("Recovery #%d shares its output %s. It can't be purged", id, out))
+		}
+	}
+	d.historyLock.Lock()
+	defer d.historyLock.Unlock()
+	for _, h := range d.history {
+		if h.Recovery.ID != r.Data.ID && !h.Purged && h.Recovery.OutputPath() == out {
+			return errors.New(op, fmt.Sprintf("Archived recovery #%d shares its output %s. It can't be purged", h.Recovery.ID, out))
+		}
+	}
+	return nil
+}
+
+// History returns archived recoveries, oldest first. If id is not zero only records of that recovery are returned
+func (d *Director) History(id int) []HistoryRecord {
+	d.historyLock.Lock()
+	defer d.historyLock.Unlock()
+	out := []HistoryRecord{}
+	for _, h := range d.history {
+		if id == 0 || h.Recovery.ID == id {
+			out = append(out, h)
+		}
+	}
+	return out
+}
+
+// saveHistory must be called holding historyLock
+func (d *Director) saveHistory() error {
+	op := "director.saveHistory()"
+	if config.Data.HistoryJSON == "" {
+		return nil
+	}
+	data, err := json.MarshalIndent(d.history, "", "  ")
+	if err != nil {
+		return errors.New(op, err)
+	}
+	if err := writeFile(config.Data.HistoryJSON, data); err != nil {
+		return errors.Extend(op, err)
+	}
+	return nil
+}
+
+func (d *Director) loadHistory() error {
+	op := "director.loadHistory()"
+	if config.Data.HistoryJSON == "" {
+		log.Alert("HistoryJSON is not set. Archived recoveries will not survive a server restart")
+		return nil
+	}
+	jsonBytes, err := ioutil.ReadFile(config.Data.HistoryJSON)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return errors.New(op, err)
+	}
+	d.historyLock.Lock()
+	defer d.historyLock.Unlock()
+	if err := json.Unmarshal(jsonBytes, &d.history); err != nil {
+		return errors.New(op, err)
+	}
+	log.Info("Loaded %d archived recoveries from %s", len(d.history), config.Data.HistoryJSON)
+	return nil
+}
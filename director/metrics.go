@@ -0,0 +1,29 @@
+package director
+
+import (
+	"github.com/morrocker/log"
+	"github.com/morrocker/recoveryserver/metrics"
+	"github.com/morrocker/recoveryserver/recovery"
+)
+
+// metricsUpdater refreshes the recoveries per state gauge every time a recovery broadcasts a change
+func (d *Director) metricsUpdater() {
+	log.TaskV("Starting Metrics Updater")
+	l := d.broadcaster.Listen()
+	for {
+		d.updateMetrics()
+		<-l.C
+	}
+}
+
+func (d *Director) updateMetrics() {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	states := make(map[recovery.State]int)
+	for _, r := range d.Recoveries {
+		states[r.Status]++
+	}
+	for _, s := range []recovery.State{recovery.Entry, recovery.Queued, recovery.Running, recovery.Paused, recovery.Done, recovery.Canceled, recovery.Suspending} {
+		metrics.Recoveries.WithLabelValues(s.String()).Set(float64(states[s]))
+	}
+}
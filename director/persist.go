@@ -0,0 +1,123 @@
+package director
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+
+	"github.com/morrocker/errors"
+	"github.com/morrocker/log"
+	"github.com/morrocker/recoveryserver/config"
+	"github.com/morrocker/recoveryserver/recovery"
+)
+
+// recoveriesKeeper saves the Recoveries registry every time a recovery broadcasts a change
+func (d *Director) recoveriesKeeper() {
+	log.TaskV("Starting Recoveries Keeper")
+	if config.Data.RecoveriesJSON == "" {
+		log.Alert("RecoveriesJSON is not set. Recoveries will not survive a server restart")
+		return
+	}
+	l := d.broadcaster.Listen()
+	var previous []byte
+	for {
+		<-l.C
+		data, err := d.marshalRecoveries()
+		if err != nil {
+			log.Errorln(errors.Extend("director.recoveriesKeeper()", err))
+			continue
+		}
+		if bytesEqual(previous, data) {
+			continue
+		}
+		if err := writeFile(config.Data.RecoveriesJSON, data); err != nil {
+			log.Errorln(errors.Extend("director.recoveriesKeeper()", err))
+			continue
+		}
+		previous = data
+	}
+}
+
+// saveRecoveries writes the Recoveries registry to RecoveriesJSON right away
+func (d *Director) saveRecoveries() error {
+	if config.Data.RecoveriesJSON == "" {
+		return nil
+	}
+	data, err := d.marshalRecoveries()
+	if err != nil {
+		return errors.Extend("director.saveRecoveries()", err)
+	}
+	if err := writeFile(config.Data.RecoveriesJSON, data); err != nil {
+		return errors.Extend("director.saveRecoveries()", err)
+	}
+	return nil
+}
+
+// loadRecoveries reads RecoveriesJSON and binds every saved recovery back to its cloud and the
+// director's broadcaster
+func (d *Director) loadRecoveries() error {
+	op := "director.loadRecoveries()"
+	if config.Data.RecoveriesJSON == "" {
+		return nil
+	}
+	log.TaskV("Loading recoveries from %s", config.Data.RecoveriesJSON)
+	jsonBytes, err := ioutil.ReadFile(config.Data.RecoveriesJSON)
+	if os.IsNotExist(err) {
+		log.InfoV("No recoveries file found on %s", config.Data.RecoveriesJSON)
+		return nil
+	} else if err != nil {
+		return errors.Extend(op, err)
+	}
+
+	saved := make(map[int]*recovery.Recovery)
+	if err := json.Unmarshal(jsonBytes, &saved); err != nil {
+		return errors.Extend(op, err)
+	}
+
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	for id, r := range saved {
+		if r.Data == nil {
+			log.Alert("Recovery #%d has no data. Skipping it", id)
+			continue
+		}
+		cloud, ok := config.Data.Clouds[r.CloudName]
+		if !ok {
+			log.Errorln(errors.New(op, fmt.Sprintf("Could not find cloud %q for recovery #%d. Skipping it", r.CloudName, id)))
+			continue
+		}
+		r.Restore(d.broadcaster, cloud)
+		d.Recoveries[id] = r
+	}
+	log.Info("Loaded %d recoveries from %s", len(d.Recoveries), config.Data.RecoveriesJSON)
+	return nil
+}
+
+func (d *Director) marshalRecoveries() ([]byte, error) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	data, err := json.MarshalIndent(d.Recoveries, "", "  ")
+	if err != nil {
+		return nil, errors.New("director.marshalRecoveries()", err)
+	}
+	return data, nil
+}
+
+// writeFile writes into a temporary file first so a crash never leaves a truncated registry
+func writeFile(filename string, data []byte) error {
+	op := "director.writeFile()"
+	tmp := filename + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0600); err != nil {
+		return errors.New(op, err)
+	}
+	if err := os.Rename(tmp, filename); err != nil {
+		return errors.New(op, err)
+	}
+	return nil
+}
+
+func bytesEqual(a, b []byte) bool {
+	return a != nil && bytes.Equal(a, b)
+}
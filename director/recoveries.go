@@ -5,6 +5,7 @@ import (
 	"io/ioutil"
 	"net/http"
 	"net/url"
+	"sort"
 	"strings"
 
 	"github.com/morrocker/errors"
@@ -13,36 +14,86 @@ import (
 	"github.com/morrocker/recoveryserver/recovery"
 )
 
-// PickRecovery decides what recovery must be executed next. It prefers higher priority over lower.
-// Will skip if a recovery is running. Has a low latency by design.
+// recoveryPicker decides what recoveries must be executed next. It prefers higher priority over lower.
+// Will only start as many recoveries as free slots are left, globally and for each cloud. Has a low latency by design.
 func (d *Director) recoveryPicker() {
 	log.TaskV("Starting Recovery Picker")
 	l := d.broadcaster.Listen()
-Loop:
 	for {
 		<-l.C
 		if !d.run {
 			log.InfoD("Director set Run to false")
 			continue
 		}
-		log.InfoD("Trying to decide new recovery to run")
-		var nextRecovery *recovery.Recovery
-		var nextPriority recovery.Priority = -1
-		for _, r := range d.Recoveries {
-			if r.Status == recovery.Running {
-				log.InfoD("A recovery is already running")
-				continue Loop
-			}
-			if r.Status == recovery.Queued && nextPriority < r.Priority && r.GetOutput() != "" {
-				log.InfoD("Found possible recovery ID:%d", r.Data.ID)
-				nextRecovery = r
-				nextPriority = r.Priority
+		log.InfoD("Trying to decide new recoveries to run")
+		for _, r := range d.pickRecoveries() {
+			log.InfoD("Starting recovery ID:%d on cloud %s", r.Data.ID, r.CloudName)
+			go r.Run()
+		}
+	}
+}
+
+// pickRecoveries claims and returns the queued recoveries with an output set that fit into the slots left
+// free by the running and paused ones, highest priority first
+func (d *Director) pickRecoveries() []*recovery.Recovery {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	var running int
+	runningPerCloud := make(map[string]int)
+	var queued []*recovery.Recovery
+	for _, r := range d.Recoveries {
+		switch r.Status {
+		// Paused and Suspending recoveries keep their execution alive, so they keep their slots
+		case recovery.Running, recovery.Paused, recovery.Suspending:
+			running++
+			runningPerCloud[r.CloudName]++
+		case recovery.Queued:
+			if r.GetOutput() != "" {
+				queued = append(queued, r)
 			}
 		}
-		if nextRecovery != nil {
-			go nextRecovery.Run()
+	}
+	sort.Slice(queued, func(i, j int) bool {
+		if queued[i].Priority == queued[j].Priority {
+			return queued[i].Data.ID < queued[j].Data.ID
 		}
+		return queued[i].Priority > queued[j].Priority
+	})
+
+	var picked []*recovery.Recovery
+	for _, r := range queued {
+		if running >= recoverySlots() {
+			log.InfoD("All %d recovery slots are in use", recoverySlots())
+			break
+		}
+		if slots := cloudSlots(r.CloudName); slots > 0 && runningPerCloud[r.CloudName] >= slots {
+			log.InfoD("All %d recovery slots for cloud %s are in use", slots, r.CloudName)
+			continue
+		}
+		// Claimed while holding the lock, so the broadcast of another recovery start can't pick it again
+		if err := r.Claim(); err != nil {
+			log.Errorln(errors.Extend("director.pickRecoveries()", err))
+			continue
+		}
+		picked = append(picked, r)
+		running++
+		runningPerCloud[r.CloudName]++
+	}
+	return picked
+}
+
+// recoverySlots returns how many recoveries may run at the same time. Defaults to one
+func recoverySlots() int {
+	if config.Data.RecoverySlots < 1 {
+		return 1
 	}
+	return config.Data.RecoverySlots
+}
+
+// cloudSlots returns how many recoveries may run at the same time for a cloud. Zero means no limit other than the global one
+func cloudSlots(name string) int {
+	return config.Data.Clouds[name].Slots
 }
 
 // ChangePriority changes a given recovery priority to a specific value
@@ -63,7 +114,10 @@ func (d *Director) AddRecovery(data *recovery.Data) error {
 	if err := checkEmptyData(data); err != nil {
 		return errors.Extend(op, err)
 	}
-	if _, ok := d.Recoveries[data.ID]; ok {
+	if err := data.Filters.Check(); err != nil {
+		return errors.Extend(op, err)
+	}
+	if _, err := d.findRecovery(data.ID); err == nil {
 		return errors.New(op, fmt.Sprintf("Recovery #%d already exists. Remove first", data.ID))
 	}
 
@@ -73,10 +127,12 @@ func (d *Director) AddRecovery(data *recovery.Data) error {
 	}
 
 	var newCloud config.Cloud
+	var cloudName string
 	var found bool
-	for _, cloud := range config.Data.Clouds {
+	for name, cloud := range config.Data.Clouds {
 		if cloud.FilesAddress == login {
 			newCloud = cloud
+			cloudName = name
 			found = true
 			break
 		}
@@ -85,7 +141,10 @@ func (d *Director) AddRecovery(data *recovery.Data) error {
 		return errors.New(op, fmt.Sprintf("Could not find cloud to match login %s", login))
 	}
 
-	d.Recoveries[data.ID] = recovery.New(data.ID, data, d.broadcaster, newCloud)
+	d.lock.Lock()
+	d.Recoveries[data.ID] = recovery.New(data.ID, data, d.broadcaster, cloudName, newCloud)
+	d.lock.Unlock()
+	d.broadcaster.Broadcast()
 	return nil
 }
 
@@ -141,6 +200,99 @@ func (d *Director) SetDestination(id int, dst string) error {
 	return nil
 }
 
+// SetArchive makes a given recovery write its output as an archive, optionally split into volumes and
+// encrypted. An empty format goes back to writing a directory tree
+func (d *Director) SetArchive(id int, a recovery.ArchiveSettings) error {
+	op := "director.SetArchive()"
+	r, err := d.findRecovery(id)
+	if err != nil {
+		return errors.Extend(op, err)
+	}
+	if err := r.SetArchive(a); err != nil {
+		return errors.Extend(op, err)
+	}
+	return nil
+}
+
+// VerifyRecovery checks a given recovery output against its manifest. root overrides the output path, e.g.
+// to check a delivery disk
+func (d *Director) VerifyRecovery(id int, root string) (*recovery.VerifyReport, error) {
+	op := "director.VerifyRecovery()"
+	r, err := d.findRecovery(id)
+	if err != nil {
+		return nil, errors.Extend(op, err)
+	}
+	v, err := r.Verify(root)
+	if err != nil {
+		return nil, errors.Extend(op, err)
+	}
+	return v, nil
+}
+
+// RecoveryErrors returns the files of a given recovery that failed or were written with missing content
+func (d *Director) RecoveryErrors(id int) ([]recovery.FileError, error) {
+	op := "director.RecoveryErrors()"
+	r, err := d.findRecovery(id)
+	if err != nil {
+		return nil, errors.Extend(op, err)
+	}
+	errs, err := r.Errors()
+	if err != nil {
+		return nil, errors.Extend(op, err)
+	}
+	return errs, nil
+}
+
+// SetMissingBlocks sets the missing block policy of a given recovery
+func (d *Director) SetMissingBlocks(id int, policy string) error {
+	op := "director.SetMissingBlocks()"
+	r, err := d.findRecovery(id)
+	if err != nil {
+		return errors.Extend(op, err)
+	}
+	if err := r.SetMissingBlocks(policy); err != nil {
+		return errors.Extend(op, err)
+	}
+	return nil
+}
+
+// SetFilters replaces the exclusion and inclusion filters of a given recovery
+func (d *Director) SetFilters(id int, f *recovery.Filters) error {
+	op := "director.SetFilters()"
+	r, err := d.findRecovery(id)
+	if err != nil {
+		return errors.Extend(op, err)
+	}
+	if err := r.SetFilters(f); err != nil {
+		return errors.Extend(op, err)
+	}
+	return nil
+}
+
+// RetryFailures queues a given Done recovery to download again only its failed files
+func (d *Director) RetryFailures(id int) error {
+	op := "director.RetryFailures()"
+	r, err := d.findRecovery(id)
+	if err != nil {
+		return errors.Extend(op, err)
+	}
+	if err := r.RetryFailures(); err != nil {
+		return errors.Extend(op, err)
+	}
+	return nil
+}
+
+// Passphrase returns the passphrase of a given recovery encrypted output. The recovery may have been
+// archived or removed already
+func (d *Director) Passphrase(id int) (string, error) {
+	op := "director.Passphrase()"
+	p, err := recovery.Passphrase(id)
+	if err != nil {
+		return "", errors.Extend(op, err)
+	}
+	return p, nil
+}
+
 // PauseRecovery sets a given recover status to Pause
 func (d *Director) PreCalculate(id int) error {
 	r, err := d.findRecovery(id)
@@ -151,9 +303,24 @@ func (d *Director) PreCalculate(id int) error {
 	return nil
 }
 
+// InvalidateCache removes the cached metafile tree of a given recovery
+func (d *Director) InvalidateCache(id int) error {
+	op := "director.InvalidateCache()"
+	r, err := d.findRecovery(id)
+	if err != nil {
+		return errors.Extend(op, err)
+	}
+	if err := r.InvalidateTreeCache(); err != nil {
+		return errors.Extend(op, err)
+	}
+	return nil
+}
+
 // accesory functions
 
 func (d *Director) findRecovery(id int) (*recovery.Recovery, error) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
 	r, ok := d.Recoveries[id]
 	if !ok {
 		return nil, errors.New("recovery.findRecovery()", fmt.Sprintf("Recovery %d not found", id))
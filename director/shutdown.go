@@ -0,0 +1,92 @@
+package director
+
+import (
+	"sync"
+	"time"
+
+	"github.com/morrocker/errors"
+	"github.com/morrocker/log"
+	"github.com/morrocker/recoveryserver/config"
+	"github.com/morrocker/recoveryserver/recovery"
+)
+
+// ShutdownTimeout returns how long running recoveries are given to reach a safe point on shutdown. Defaults to 30 seconds
+func ShutdownTimeout() time.Duration {
+	if config.Data.ShutdownTimeout < 1 {
+		return 30 * time.Second
+	}
+	return time.Duration(config.Data.ShutdownTimeout) * time.Second
+}
+
+// Shutdown stops picking recoveries, suspends the running ones so they resume after a restart, saves
+// the Recoveries registry and optionally unmounts the mounted disks. It returns an error if any step failed
+func (d *Director) Shutdown() error {
+	op := "director.Shutdown()"
+	var failed bool
+	d.shutdownOnce.Do(func() {
+		log.Task("Shutting down director")
+		d.Stop()
+
+		d.lock.Lock()
+		var running []*recovery.Recovery
+		for _, r := range d.Recoveries {
+			if r.Status == recovery.Running {
+				running = append(running, r)
+			}
+		}
+		d.lock.Unlock()
+
+		timeout := ShutdownTimeout()
+		var wg sync.WaitGroup
+		var mu sync.Mutex
+		for _, r := range running {
+			wg.Add(1)
+			go func(r *recovery.Recovery) {
+				defer wg.Done()
+				if err := r.Suspend(timeout); err != nil {
+					log.Errorln(errors.Extend(op, err))
+					mu.Lock()
+					failed = true
+					mu.Unlock()
+				}
+			}(r)
+		}
+		wg.Wait()
+
+		if err := d.saveRecoveries(); err != nil {
+			log.Errorln(errors.Extend(op, err))
+			failed = true
+		}
+		if config.Data.UnmountOnShutdown {
+			if !d.unmountAll() {
+				failed = true
+			}
+		}
+		if d.done != nil {
+			close(d.done)
+		}
+	})
+	if failed {
+		return errors.New(op, "Director did not shut down cleanly")
+	}
+	return nil
+}
+
+// unmountAll unmounts every device mounted under MountRoot. Returns false if any of them failed
+func (d *Director) unmountAll() bool {
+	ok := true
+	for serial, dev := range d.devices {
+		mountpoint := config.Data.MountRoot + serial
+		for _, p := range dev.DevData.Partitions {
+			if p.MountPoint != mountpoint {
+				continue
+			}
+			if err := d.UnmountDisk(serial); err != nil {
+				log.Errorln(errors.Extend("director.unmountAll()", err))
+				ok = false
+			}
+			break
+		}
+	}
+	return ok
+}
@@ -3,6 +3,7 @@ module github.com/morrocker/recoveryserver
 go 1.16
 
 require (
+	github.com/alexmullins/zip v0.0.0-20180717182244-4affb64b04d0
 	github.com/clonercl/blockserver v0.1.9-0.20210223125923-da5a759ce04e
 	github.com/clonercl/kaon v0.1.8
 	github.com/clonercl/reposerver v0.0.0-20190806151941-b7d532a8c047
@@ -18,10 +19,11 @@ require (
 	github.com/morrocker/log v0.0.0-20210322121956-1387843cccea
 	github.com/morrocker/progress-tracker v0.0.0-20210325143638-ad470534c561
 	github.com/morrocker/utils v0.0.0-20210326152034-ee75a97c3c41
+	github.com/prometheus/client_golang v1.7.1
 	github.com/sirupsen/logrus v1.8.1 // indirect
 	github.com/spf13/pflag v1.0.5
 	github.com/ugorji/go v1.2.5 // indirect
-	golang.org/x/crypto v0.0.0-20210322153248-0c34fe9e7dc2 // indirect
+	golang.org/x/crypto v0.0.0-20210322153248-0c34fe9e7dc2
 	golang.org/x/sys v0.0.0-20210330210617-4fbd30eecc44 // indirect
 	golang.org/x/text v0.3.5
 	gopkg.in/yaml.v2 v2.4.0 // indirect
@@ -1,19 +1,30 @@
 package main
 
 import (
+	"os"
+
 	"github.com/morrocker/log"
 	"github.com/morrocker/recoveryserver/config"
 	"github.com/morrocker/recoveryserver/server"
 )
 
-func init() {
+func setup() {
 	config.Data.Load()
 	config.SetLogger()
 	config.CreatePDFDir()
+	config.CreateJournalDir()
+	config.CreateTreeCacheDir()
+	config.CreateStagingDir()
+	config.SetBlockCacheDir()
+	config.SetSecrets()
 }
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "verify" {
+		os.Exit(verify(os.Args[2:]))
+	}
+	setup()
 	server := server.New()
 	log.Task("Starting Server")
-	server.StartServer()
+	os.Exit(server.StartServer())
 }
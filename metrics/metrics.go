@@ -0,0 +1,141 @@
+package metrics
+
+import "github.com/prometheus/client_golang/prometheus"
+
+const namespace = "recoveryserver"
+
+var (
+	// Recoveries counts recoveries on each state
+	Recoveries = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "recoveries",
+		Help:      "Number of recoveries on each state.",
+	}, []string{"state"})
+
+	// BlocksDownloaded counts blocks retrieved from each store
+	BlocksDownloaded = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "blocks_downloaded_total",
+		Help:      "Blocks retrieved from each store.",
+	}, []string{"cloud", "store"})
+
+	// BytesDownloaded counts bytes retrieved from each store
+	BytesDownloaded = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "bytes_downloaded_total",
+		Help:      "Bytes retrieved from each store.",
+	}, []string{"cloud", "store"})
+
+	// BlockErrors counts failed block retrievals on each store, including blocks failing verification
+	BlockErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "block_errors_total",
+		Help:      "Failed block retrievals on each store.",
+	}, []string{"cloud", "store", "reason"})
+
+	// BlockRetries counts retrieval passes over a cloud's stores after the first one failed
+	BlockRetries = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "block_retries_total",
+		Help:      "Block retrieval passes repeated after every store failed.",
+	}, []string{"cloud"})
+
+	// StoreLatency tracks the smoothed block retrieval latency of each store
+	StoreLatency = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "store_latency_seconds",
+		Help:      "Smoothed block retrieval latency of each store.",
+	}, []string{"cloud", "store"})
+
+	// StoreCircuitOpen is 1 while a store is skipped after failing repeatedly
+	StoreCircuitOpen = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "store_circuit_open",
+		Help:      "Whether a store is being skipped after failing repeatedly.",
+	}, []string{"cloud", "store"})
+
+	// HedgedRequests counts block requests raced against a second store
+	HedgedRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "hedged_requests_total",
+		Help:      "Block requests raced against a second store after exceeding the latency percentile.",
+	}, []string{"cloud"})
+
+	// HedgeWins counts hedged requests answered by the second store first
+	HedgeWins = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "hedge_wins_total",
+		Help:      "Hedged requests answered by the second store first.",
+	}, []string{"cloud"})
+
+	// BlockCacheLookups counts local block cache lookups by result
+	BlockCacheLookups = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "block_cache_lookups_total",
+		Help:      "Local block cache lookups by result.",
+	}, []string{"result"})
+
+	// MetafileRequests counts requests made to the files server for metafiles and their children
+	MetafileRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "metafile_requests_total",
+		Help:      "Requests made to the files server.",
+	}, []string{"cloud", "result"})
+
+	// Workers counts started workers of each kind
+	Workers = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "workers",
+		Help:      "Started workers of each kind.",
+	}, []string{"kind"})
+
+	// BusyWorkers counts workers of each kind currently processing an item
+	BusyWorkers = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "busy_workers",
+		Help:      "Workers of each kind currently processing an item.",
+	}, []string{"kind"})
+
+	// MountedDevices counts devices with at least one mounted partition
+	MountedDevices = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "mounted_devices",
+		Help:      "Devices with at least one mounted partition.",
+	})
+
+	// Devices counts devices found by the devices scanner
+	Devices = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "devices",
+		Help:      "Devices found by the devices scanner.",
+	})
+
+	// RequestDuration measures HTTP requests latency per route
+	RequestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "http_request_duration_seconds",
+		Help:      "HTTP requests latency per route.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"route", "method", "code"})
+)
+
+func init() {
+	prometheus.MustRegister(
+		Recoveries,
+		BlocksDownloaded,
+		BytesDownloaded,
+		BlockErrors,
+		BlockRetries,
+		StoreLatency,
+		StoreCircuitOpen,
+		HedgedRequests,
+		HedgeWins,
+		BlockCacheLookups,
+		MetafileRequests,
+		Workers,
+		BusyWorkers,
+		MountedDevices,
+		Devices,
+		RequestDuration,
+	)
+}
@@ -0,0 +1,158 @@
+package recovery
+
+import (
+	"archive/zip"
+	"compress/flate"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/binary"
+	"hash"
+	"io"
+
+	"github.com/morrocker/errors"
+	"golang.org/x/crypto/pbkdf2"
+)
+
+// WinZip AES (AE-1) encryption, readable by 7-Zip, WinZip and most archive tools. Entries are deflated,
+// then encrypted with AES-256 in CTR mode and authenticated with HMAC-SHA1
+const (
+	aesZipMethod     = 99
+	aesZipExtraID    = 0x9901
+	aesZipSaltLen    = 16
+	aesZipKeyLen     = 32
+	aesZipIterations = 1000
+	aesZipAuthLen    = 10
+)
+
+// aesZipExtra returns the extra field that marks an entry as AES-256 encrypted and deflated
+func aesZipExtra() []byte {
+	extra := make([]byte, 11)
+	binary.LittleEndian.PutUint16(extra[0:], aesZipExtraID)
+	binary.LittleEndian.PutUint16(extra[2:], 7)
+	binary.LittleEndian.PutUint16(extra[4:], 1) // AE-1 keeps the CRC of the plain content
+	copy(extra[6:], "AE")
+	extra[8] = 3 // AES-256
+	binary.LittleEndian.PutUint16(extra[9:], zip.Deflate)
+	return extra
+}
+
+// aesZipHeader turns a zip header into an AES encrypted one
+func aesZipHeader(fh *zip.FileHeader) *zip.FileHeader {
+	fh.Method = aesZipMethod
+	fh.Flags |= 0x1
+	fh.Extra = append(fh.Extra, aesZipExtra()...)
+	return fh
+}
+
+// registerAESZip makes zw encrypt every entry created with an aesZipHeader using passphrase
+func registerAESZip(zw *zip.Writer, passphrase string) {
+	zw.RegisterCompressor(aesZipMethod, func(w io.Writer) (io.WriteCloser, error) {
+		return newAESZipWriter(w, passphrase)
+	})
+}
+
+// aesZipWriter deflates and encrypts a single entry
+type aesZipWriter struct {
+	dst     io.Writer
+	deflate *flate.Writer
+	ctr     *aesZipCTR
+	mac     hash.Hash
+	header  []byte
+}
+
+func newAESZipWriter(dst io.Writer, passphrase string) (*aesZipWriter, error) {
+	op := "recovery.newAESZipWriter()"
+	salt := make([]byte, aesZipSaltLen)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, errors.New(op, err)
+	}
+	keys := pbkdf2.Key([]byte(passphrase), salt, aesZipIterations, 2*aesZipKeyLen+2, sha1.New)
+	block, err := aes.NewCipher(keys[:aesZipKeyLen])
+	if err != nil {
+		return nil, errors.New(op, err)
+	}
+	// Salt and password verifier go before the encrypted data. The zip writer creates the compressor
+	// before writing the entry local header, so they are held until the first write
+	w := &aesZipWriter{
+		dst:    dst,
+		ctr:    &aesZipCTR{block: block},
+		mac:    hmac.New(sha1.New, keys[aesZipKeyLen:2*aesZipKeyLen]),
+		header: append(salt, keys[2*aesZipKeyLen:]...),
+	}
+	w.deflate, err = flate.NewWriter(writerFunc(w.encrypt), flate.DefaultCompression)
+	if err != nil {
+		return nil, errors.New(op, err)
+	}
+	return w, nil
+}
+
+// writerFunc adapts a function to io.Writer
+type writerFunc func(p []byte) (int, error)
+
+func (f writerFunc) Write(p []byte) (int, error) {
+	return f(p)
+}
+
+// writeHeader writes the salt and password verifier if they were not written yet
+func (w *aesZipWriter) writeHeader() error {
+	if w.header == nil {
+		return nil
+	}
+	_, err := w.dst.Write(w.header)
+	w.header = nil
+	return err
+}
+
+func (w *aesZipWriter) encrypt(p []byte) (int, error) {
+	if err := w.writeHeader(); err != nil {
+		return 0, err
+	}
+	out := make([]byte, len(p))
+	w.ctr.xor(out, p)
+	w.mac.Write(out)
+	return w.dst.Write(out)
+}
+
+func (w *aesZipWriter) Write(p []byte) (int, error) {
+	return w.deflate.Write(p)
+}
+
+// Close flushes the compressed data and appends the authentication code
+func (w *aesZipWriter) Close() error {
+	if err := w.deflate.Close(); err != nil {
+		return err
+	}
+	if err := w.writeHeader(); err != nil {
+		return err
+	}
+	_, err := w.dst.Write(w.mac.Sum(nil)[:aesZipAuthLen])
+	return err
+}
+
+// aesZipCTR is the CTR mode used by WinZip AES: a little endian block counter starting at 1
+type aesZipCTR struct {
+	block   cipher.Block
+	counter [aes.BlockSize]byte
+	stream  [aes.BlockSize]byte
+	used    int
+}
+
+func (c *aesZipCTR) xor(dst, src []byte) {
+	for i := range src {
+		if c.used == 0 || c.used == aes.BlockSize {
+			for j := range c.counter {
+				c.counter[j]++
+				if c.counter[j] != 0 {
+					break
+				}
+			}
+			c.block.Encrypt(c.stream[:], c.counter[:])
+			c.used = 0
+		}
+		dst[i] = src[i] ^ c.stream[c.used]
+		c.used++
+	}
+}
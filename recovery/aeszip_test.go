@@ -0,0 +1,97 @@
+package recovery
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	aeszip "github.com/alexmullins/zip"
+)
+
+// TestAESZipInterop decrypts an encrypted archive with an independent WinZip AES reader
+func TestAESZipInterop(t *testing.T) {
+	dir, err := ioutil.TempDir("", "aeszip")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	staging := filepath.Join(dir, "staging")
+	if err := os.MkdirAll(filepath.Join(staging, "docs"), 0700); err != nil {
+		t.Fatal(err)
+	}
+
+	random := make([]byte, 70000)
+	if _, err := rand.Read(random); err != nil {
+		t.Fatal(err)
+	}
+	files := map[string][]byte{
+		"docs/random.bin": random,
+		"docs/text.txt":   bytes.Repeat([]byte("recovered content\n"), 5000),
+		"empty.txt":       {},
+	}
+	const passphrase = "correct horse battery staple"
+	out := filepath.Join(dir, "out.zip")
+	aw, err := newArchiveWriter(&ArchiveSettings{Format: ZipFormat, Encrypt: true}, out, staging, passphrase)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, content := range files {
+		p := filepath.Join(staging, name)
+		if err := ioutil.WriteFile(p, content, 0600); err != nil {
+			t.Fatal(err)
+		}
+		if err := aw.addFile(p, time.Time{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := aw.close(); err != nil {
+		t.Fatal(err)
+	}
+
+	zr, err := aeszip.OpenReader(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer zr.Close()
+	if len(zr.File) != len(files) {
+		t.Fatalf("archive has %d entries, want %d", len(zr.File), len(files))
+	}
+	for _, f := range zr.File {
+		want, ok := files[f.Name]
+		if !ok {
+			t.Errorf("unexpected entry %q", f.Name)
+			continue
+		}
+		if !f.IsEncrypted() {
+			t.Errorf("entry %q is not encrypted", f.Name)
+		}
+		f.SetPassword(passphrase)
+		rc, err := f.Open()
+		if err != nil {
+			t.Errorf("opening %q: %v", f.Name, err)
+			continue
+		}
+		got, err := ioutil.ReadAll(rc)
+		rc.Close()
+		if err != nil {
+			t.Errorf("reading %q: %v", f.Name, err)
+			continue
+		}
+		if !bytes.Equal(got, want) {
+			t.Errorf("entry %q decrypted to %d bytes that don't match the %d written", f.Name, len(got), len(want))
+		}
+	}
+
+	f := zr.File[0]
+	f.SetPassword("wrong passphrase")
+	if rc, err := f.Open(); err == nil {
+		if _, err := ioutil.ReadAll(rc); err == nil {
+			t.Errorf("entry %q was read with a wrong passphrase", f.Name)
+		}
+		rc.Close()
+	}
+}
@@ -0,0 +1,278 @@
+package recovery
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"time"
+
+	"github.com/morrocker/errors"
+	"github.com/morrocker/recoveryserver/config"
+	"golang.org/x/text/unicode/norm"
+)
+
+// Archive formats a recovery can be written as instead of a directory tree
+const (
+	TarFormat   = "tar"
+	TarGzFormat = "tar.gz"
+	ZipFormat   = "zip"
+)
+
+// ArchiveSettings makes a recovery stream its files into a single archive. With VolumeSize set the
+// archive is split into numbered volumes of that many bytes, which are joined back with cat. Encrypt
+// protects every zip entry with AES-256 under a passphrase generated by the server.
+// Archives are written in a single pass and can't be appended to, so an archive recovery is never resumed.
+// If it is suspended by a shutdown or run again after a restart, every file is downloaded again
+type ArchiveSettings struct {
+	Format     string `json:"format"`
+	VolumeSize int64  `json:"volumeSize,omitempty"`
+	Encrypt    bool   `json:"encrypt,omitempty"`
+}
+
+// SetArchive sets the recovery archive output. An empty format writes a directory tree again
+func (r *Recovery) SetArchive(a ArchiveSettings) error {
+	op := "recovery.SetArchive()"
+	if err := r.CanRemove(); err != nil {
+		return errors.Extend(op, err)
+	}
+	if a.VolumeSize < 0 {
+		return errors.New(op, "Volume size can't be negative")
+	}
+	switch a.Format {
+	case "":
+		if a.Encrypt {
+			return errors.New(op, "Encrypted output needs the zip format")
+		}
+		r.Archive = nil
+		r.notify()
+		return nil
+	case TarFormat, TarGzFormat:
+		if a.Encrypt {
+			return errors.New(op, "Encrypted output needs the zip format")
+		}
+	case ZipFormat:
+	default:
+		return errors.New(op, fmt.Sprintf("Unknown archive format %q. Use tar, tar.gz or zip", a.Format))
+	}
+	if a.Encrypt {
+		if _, err := r.ensurePassphrase(); err != nil {
+			return errors.Extend(op, err)
+		}
+	}
+	r.Archive = &a
+	r.notify()
+	return nil
+}
+
+// stagingPath returns where files are downloaded before going into the archive. It is on the server
+// StagingDir, so plain content never touches the delivery disk
+func (r *Recovery) stagingPath() string {
+	return path.Join(config.Data.StagingDir, fmt.Sprintf("%d", r.Data.ID))
+}
+
+// archiveWriter streams files from the staging directory into an archive, one at a time
+type archiveWriter struct {
+	staging string
+	out     *volumeWriter
+	gz      *gzip.Writer
+	tw      *tar.Writer
+	zw      *zip.Writer
+	encrypt bool
+}
+
+// newArchiveWriter creates the archive on filename. Entries are named after their path under staging.
+// A passphrase is only used by encrypted zip archives
+func newArchiveWriter(a *ArchiveSettings, filename, staging, passphrase string) (*archiveWriter, error) {
+	op := "recovery.newArchiveWriter()"
+	out, err := newVolumeWriter(filename, a.VolumeSize)
+	if err != nil {
+		return nil, errors.Extend(op, err)
+	}
+	w := &archiveWriter{staging: staging, out: out}
+	switch a.Format {
+	case TarFormat:
+		w.tw = tar.NewWriter(out)
+	case TarGzFormat:
+		w.gz = gzip.NewWriter(out)
+		w.tw = tar.NewWriter(w.gz)
+	case ZipFormat:
+		w.zw = zip.NewWriter(out)
+		if a.Encrypt {
+			registerAESZip(w.zw, passphrase)
+			w.encrypt = true
+		}
+	}
+	return w, nil
+}
+
+func (w *archiveWriter) entryName(p string) (string, error) {
+	rel, err := filepath.Rel(w.staging, p)
+	if err != nil {
+		return "", err
+	}
+	return filepath.ToSlash(norm.NFC.String(rel)), nil
+}
+
+// addFile copies a staged file into the archive and removes it from the staging directory. Entries keep
+// the staged file permissions, which already follow the output permission policy
+func (w *archiveWriter) addFile(p string, modTime time.Time) error {
+	op := "recovery.archiveWriter.addFile()"
+	name, err := w.entryName(p)
+	if err != nil {
+		return errors.New(op, err)
+	}
+	f, err := os.Open(norm.NFC.String(p))
+	if err != nil {
+		return errors.New(op, err)
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return errors.New(op, err)
+	}
+	if modTime.IsZero() {
+		modTime = info.ModTime()
+	}
+
+	var dst io.Writer
+	if w.zw != nil {
+		fh := &zip.FileHeader{Name: name, Method: zip.Deflate, Modified: modTime}
+		fh.SetMode(info.Mode().Perm())
+		if w.encrypt {
+			fh = aesZipHeader(fh)
+		}
+		dst, err = w.zw.CreateHeader(fh)
+	} else {
+		err = w.tw.WriteHeader(&tar.Header{Typeflag: tar.TypeReg, Name: name, Size: info.Size(), Mode: int64(info.Mode().Perm()), ModTime: modTime})
+		dst = w.tw
+	}
+	if err != nil {
+		return errors.New(op, err)
+	}
+	if _, err := io.Copy(dst, f); err != nil {
+		return errors.New(op, err)
+	}
+	f.Close()
+	if err := os.Remove(norm.NFC.String(p)); err != nil {
+		return errors.New(op, err)
+	}
+	return nil
+}
+
+// addDirs adds an entry for every folder left on the staging directory, so empty folders are kept
+func (w *archiveWriter) addDirs() error {
+	op := "recovery.archiveWriter.addDirs()"
+	err := filepath.Walk(w.staging, func(p string, info os.FileInfo, err error) error {
+		if err != nil || !info.IsDir() || p == w.staging {
+			return nil
+		}
+		name, err := w.entryName(p)
+		if err != nil {
+			return err
+		}
+		if w.zw != nil {
+			fh := &zip.FileHeader{Name: name + "/", Modified: info.ModTime()}
+			fh.SetMode(info.Mode())
+			_, err = w.zw.CreateHeader(fh)
+			return err
+		}
+		return w.tw.WriteHeader(&tar.Header{Typeflag: tar.TypeDir, Name: name + "/", Mode: int64(info.Mode().Perm()), ModTime: info.ModTime()})
+	})
+	if err != nil {
+		return errors.New(op, err)
+	}
+	return nil
+}
+
+// close finishes the archive and its last volume
+func (w *archiveWriter) close() error {
+	op := "recovery.archiveWriter.close()"
+	var err error
+	if w.zw != nil {
+		err = w.zw.Close()
+	} else {
+		err = w.tw.Close()
+		if w.gz != nil {
+			if gzErr := w.gz.Close(); err == nil {
+				err = gzErr
+			}
+		}
+	}
+	if outErr := w.out.Close(); err == nil {
+		err = outErr
+	}
+	if err != nil {
+		return errors.New(op, err)
+	}
+	return nil
+}
+
+// volumeWriter writes a byte stream to filename, or to filename.001, filename.002 and so on when a
+// volume size is set
+type volumeWriter struct {
+	filename string
+	size     int64
+	volume   int
+	written  int64
+	f        *os.File
+}
+
+func newVolumeWriter(filename string, size int64) (*volumeWriter, error) {
+	v := &volumeWriter{filename: filename, size: size}
+	if err := v.next(); err != nil {
+		return nil, errors.Extend("recovery.newVolumeWriter()", err)
+	}
+	return v, nil
+}
+
+func (v *volumeWriter) next() error {
+	if v.f != nil {
+		if err := v.f.Close(); err != nil {
+			return errors.New("recovery.volumeWriter.next()", err)
+		}
+	}
+	name := v.filename
+	if v.size > 0 {
+		v.volume++
+		name = fmt.Sprintf("%s.%03d", v.filename, v.volume)
+	}
+	f, err := os.Create(name)
+	if err != nil {
+		return errors.New("recovery.volumeWriter.next()", err)
+	}
+	v.f = f
+	v.written = 0
+	return nil
+}
+
+func (v *volumeWriter) Write(p []byte) (int, error) {
+	var n int
+	for len(p) > 0 {
+		if v.size > 0 && v.written == v.size {
+			if err := v.next(); err != nil {
+				return n, err
+			}
+		}
+		chunk := p
+		if v.size > 0 && int64(len(chunk)) > v.size-v.written {
+			chunk = chunk[:v.size-v.written]
+		}
+		w, err := v.f.Write(chunk)
+		n += w
+		v.written += int64(w)
+		if err != nil {
+			return n, err
+		}
+		p = p[w:]
+	}
+	return n, nil
+}
+
+func (v *volumeWriter) Close() error {
+	return v.f.Close()
+}
@@ -0,0 +1,118 @@
+package recovery
+
+import (
+	"io/ioutil"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/clonercl/reposerver"
+	"github.com/morrocker/errors"
+	"github.com/morrocker/recoveryserver/config"
+	"golang.org/x/text/unicode/norm"
+)
+
+// metafileModTime returns the modification time the metafile recorded for its file or folder. Zero if it
+// recorded none
+func metafileModTime(mf *reposerver.Metafile) time.Time {
+	if mf.Mtime.IsZero() || mf.Mtime.Year() <= 1 {
+		return time.Time{}
+	}
+	return mf.Mtime
+}
+
+// applyMetafileTimes sets the modification time recorded by a metafile on p. Metafiles record no access
+// time, so it is set to the modification time too
+func applyMetafileTimes(p string, mf *reposerver.Metafile) error {
+	t := metafileModTime(mf)
+	if t.IsZero() {
+		return nil
+	}
+	return os.Chtimes(p, t, t)
+}
+
+// parseMode parses an octal permission string like "0644"
+func parseMode(s string) (os.FileMode, error) {
+	m, err := strconv.ParseUint(s, 8, 32)
+	if err != nil || m > 0777 {
+		return 0, errors.New("recovery.parseMode()", "Invalid permissions "+strconv.Quote(s)+", expected an octal value like 0644")
+	}
+	return os.FileMode(m), nil
+}
+
+// CheckOutputModes returns an error if OutputFileMode or OutputDirMode are set to invalid values
+func CheckOutputModes() error {
+	for _, s := range []string{config.Data.OutputFileMode, config.Data.OutputDirMode} {
+		if s == "" {
+			continue
+		}
+		if _, err := parseMode(s); err != nil {
+			return errors.Extend("recovery.CheckOutputModes()", err)
+		}
+	}
+	return nil
+}
+
+// outputFileMode returns the permissions of restored files. ok is false when OutputFileMode is not set,
+// leaving files with the default permissions of the process
+func outputFileMode() (mode os.FileMode, ok bool) {
+	if config.Data.OutputFileMode == "" {
+		return 0, false
+	}
+	mode, err := parseMode(config.Data.OutputFileMode)
+	return mode, err == nil
+}
+
+// writeSidecar writes a file the server adds next to the recovered ones, like the manifest. Its permissions
+// follow OutputFileMode and default to 0600
+func writeSidecar(filename string, data []byte) error {
+	mode, ok := outputFileMode()
+	if !ok {
+		mode = 0600
+	}
+	if err := ioutil.WriteFile(filename, data, mode); err != nil {
+		return err
+	}
+	return os.Chmod(filename, mode)
+}
+
+// outputDirMode returns the permissions of restored folders. Defaults to 0700
+func outputDirMode() os.FileMode {
+	if mode, err := parseMode(config.Data.OutputDirMode); err == nil {
+		return mode
+	}
+	return 0700
+}
+
+// restoreFileAttrs applies the output file permissions and the metafile modification time to a written file
+func (r *Recovery) restoreFileAttrs(mt *MetaTree) error {
+	op := "recovery.restoreFileAttrs()"
+	p := norm.NFC.String(mt.path)
+	if mode, ok := outputFileMode(); ok {
+		if err := os.Chmod(p, mode); err != nil {
+			return errors.New(op, err)
+		}
+	}
+	if err := applyMetafileTimes(p, mt.mf); err != nil {
+		return errors.New(op, err)
+	}
+	return nil
+}
+
+// restoreDirAttrs applies the output folder permissions and the metafile modification times to every
+// folder of the tree. It must run once every file is written, since writing a file changes its folder times
+func (r *Recovery) restoreDirAttrs(mt *MetaTree) {
+	if mt == nil || mt.mf.Type != reposerver.FolderType || mt.path == "" {
+		return
+	}
+	for _, child := range mt.children {
+		r.restoreDirAttrs(child)
+	}
+	p := norm.NFC.String(mt.path)
+	if err := os.Chmod(p, outputDirMode()); err != nil && !os.IsNotExist(err) {
+		r.log.Alert("Could not set permissions of folder %s: %v", mt.path, err)
+	}
+	if err := applyMetafileTimes(p, mt.mf); err != nil && !os.IsNotExist(err) {
+		r.log.Alert("Could not set times of folder %s: %v", mt.path, err)
+	}
+}
@@ -0,0 +1,53 @@
+package recovery
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/clonercl/reposerver"
+)
+
+func TestMetafileModTime(t *testing.T) {
+	want := time.Date(2020, 5, 17, 10, 30, 0, 0, time.UTC)
+	if got := metafileModTime(&reposerver.Metafile{Name: "a.txt", Mtime: want}); !got.Equal(want) {
+		t.Errorf("metafileModTime() = %s, want %s", got, want)
+	}
+	if got := metafileModTime(&reposerver.Metafile{Name: "a.txt"}); !got.IsZero() {
+		t.Errorf("metafileModTime() = %s for a metafile without a time, want zero", got)
+	}
+}
+
+func TestApplyMetafileTimes(t *testing.T) {
+	dir, err := ioutil.TempDir("", "attrs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	p := filepath.Join(dir, "a.txt")
+	if err := ioutil.WriteFile(p, []byte("a"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	want := time.Date(2020, 5, 17, 10, 30, 0, 0, time.UTC)
+	if err := applyMetafileTimes(p, &reposerver.Metafile{Name: "a.txt", Mtime: want}); err != nil {
+		t.Fatal(err)
+	}
+	fi, err := os.Stat(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !fi.ModTime().Equal(want) {
+		t.Errorf("modification time %s, want %s", fi.ModTime(), want)
+	}
+
+	// A metafile without a time leaves the file as it is
+	if err := applyMetafileTimes(p, &reposerver.Metafile{Name: "a.txt"}); err != nil {
+		t.Fatal(err)
+	}
+	if fi, err := os.Stat(p); err != nil || !fi.ModTime().Equal(want) {
+		t.Errorf("modification time changed by a metafile without a time")
+	}
+}
@@ -0,0 +1,196 @@
+package recovery
+
+import (
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"sync/atomic"
+	"time"
+
+	"github.com/clonercl/reposerver"
+	"github.com/morrocker/errors"
+	"github.com/morrocker/recoveryserver/config"
+	"golang.org/x/text/unicode/norm"
+)
+
+// cachedTree is the on disk representation of a MetaTree
+type cachedTree struct {
+	Metafile *reposerver.Metafile `json:"mf"`
+	Children []*cachedTree        `json:"children,omitempty"`
+}
+
+// treeCache is the content of a tree cache file
+type treeCache struct {
+	Created    time.Time   `json:"created"`
+	Repository string      `json:"repository"`
+	Metafile   string      `json:"metafile"`
+	Version    int         `json:"version"`
+	Deleted    bool        `json:"deleted"`
+	Tree       *cachedTree `json:"tree"`
+}
+
+// treeCacheMaxAge returns how long a cached tree can be used. Defaults to 24 hours
+func treeCacheMaxAge() time.Duration {
+	if config.Data.TreeCacheMaxAge < 1 {
+		return 24 * time.Hour
+	}
+	return time.Duration(config.Data.TreeCacheMaxAge) * time.Hour
+}
+
+// treeCachePath returns the cache file for the recovery cloud, login server, repository, metafile, version,
+// deleted flag and filters, since a filtered walk leaves part of the tree out. Repository and metafile ids
+// are only unique within a cloud
+func (r *Recovery) treeCachePath() string {
+	key := fmt.Sprintf("%s|%s|%s|%s|%d|%t", r.CloudName, r.LoginServer, r.Data.Repository, r.Data.Metafile, r.Data.Version, r.Data.Deleted)
+	if f := r.filtersKey(); f != "" {
+		key += "|" + f
+	}
+	sum := sha256.Sum256([]byte(key))
+	return path.Join(config.Data.TreeCacheDir, hex.EncodeToString(sum[:])+".json.gz")
+}
+
+// saveTreeCache writes a walked tree into the local cache
+func (r *Recovery) saveTreeCache(mt *MetaTree) error {
+	op := "recovery.saveTreeCache()"
+	filename := r.treeCachePath()
+	tmp := filename + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return errors.New(op, err)
+	}
+	zw := gzip.NewWriter(f)
+	tc := treeCache{
+		Created:    time.Now(),
+		Repository: r.Data.Repository,
+		Metafile:   r.Data.Metafile,
+		Version:    r.Data.Version,
+		Deleted:    r.Data.Deleted,
+		Tree:       toCachedTree(mt),
+	}
+	if err := json.NewEncoder(zw).Encode(tc); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return errors.New(op, err)
+	}
+	if err := zw.Close(); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return errors.New(op, err)
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(tmp)
+		return errors.New(op, err)
+	}
+	if err := os.Rename(tmp, filename); err != nil {
+		return errors.New(op, err)
+	}
+	r.log.Info("Saved metafile tree to cache %s", filename)
+	return nil
+}
+
+// cacheTree saves a tree into the local cache unless some of its folders could not be retrieved
+func (r *Recovery) cacheTree(mt *MetaTree) {
+	if r.stopped() {
+		return
+	}
+	if n := atomic.LoadInt64(&r.walkFailures); n > 0 {
+		r.log.Alert("Metafile tree is missing %d folders. It will not be cached", n)
+		return
+	}
+	if err := r.saveTreeCache(mt); err != nil {
+		r.log.Errorln(errors.Extend("recovery.cacheTree()", err))
+	}
+}
+
+// loadTreeCache returns the cached tree for the recovery if there is one younger than the age limit
+func (r *Recovery) loadTreeCache() (*MetaTree, error) {
+	return r.readTreeCache(treeCacheMaxAge())
+}
+
+// readTreeCache returns the cached tree for the recovery if there is one younger than maxAge. A zero
+// maxAge accepts a tree of any age
+func (r *Recovery) readTreeCache(maxAge time.Duration) (*MetaTree, error) {
+	op := "recovery.readTreeCache()"
+	f, err := os.Open(r.treeCachePath())
+	if err != nil {
+		return nil, errors.New(op, err)
+	}
+	defer f.Close()
+	zr, err := gzip.NewReader(f)
+	if err != nil {
+		return nil, errors.New(op, err)
+	}
+	var tc treeCache
+	if err := json.NewDecoder(zr).Decode(&tc); err != nil {
+		return nil, errors.New(op, err)
+	}
+	if age := time.Since(tc.Created); maxAge > 0 && age > maxAge {
+		return nil, errors.New(op, fmt.Sprintf("cached tree is %s old", age.Truncate(time.Second)))
+	}
+	if tc.Tree == nil || tc.Tree.Metafile == nil {
+		return nil, errors.New(op, "cached tree is empty")
+	}
+	return fromCachedTree(tc.Tree), nil
+}
+
+// InvalidateTreeCache removes the cached tree of the recovery, if any
+func (r *Recovery) InvalidateTreeCache() error {
+	if err := os.Remove(r.treeCachePath()); err != nil && !os.IsNotExist(err) {
+		return errors.New("recovery.InvalidateTreeCache()", err)
+	}
+	return nil
+}
+
+func toCachedTree(mt *MetaTree) *cachedTree {
+	ct := &cachedTree{Metafile: mt.mf}
+	for _, child := range mt.children {
+		ct.Children = append(ct.Children, toCachedTree(child))
+	}
+	return ct
+}
+
+func fromCachedTree(ct *cachedTree) *MetaTree {
+	mt := newMetaTree(ct.Metafile)
+	for _, child := range ct.Children {
+		mt.children = append(mt.children, fromCachedTree(child))
+	}
+	return mt
+}
+
+// setTreePaths sets the output path and the path relative to the recovery root of every node of a cached
+// tree, with mt written at p
+func setTreePaths(mt *MetaTree, p, rel string) {
+	mt.path = p
+	mt.rel = rel
+	for _, child := range mt.children {
+		setTreePaths(child, path.Join(p, child.mf.Name), path.Join(rel, child.mf.Name))
+	}
+}
+
+// feedTree walks a cached tree the same way GetRecoveryTree walks the remote one, creating folders and
+// sending every file through fc. rel is the path of mt relative to the recovery root
+func (r *Recovery) feedTree(filepath, rel string, mt *MetaTree, fc chan *MetaTree) {
+	r.tracker.ChangeTotal("metafiles", 1)
+	defer r.tracker.IncreaseCurr("metafiles")
+	mt.path = filepath
+	mt.rel = rel
+	if mt.mf.Type != reposerver.FolderType {
+		r.updateTrackerTotals(mt.mf.Size)
+		fc <- mt
+		return
+	}
+	if err := os.MkdirAll(norm.NFC.String(filepath), outputDirMode()); err != nil {
+		r.increaseErrors()
+		r.log.Errorln(errors.New("recovery.feedTree()", fmt.Sprintf("could not create path '%s': %v", filepath, err)))
+	}
+	for _, child := range mt.children {
+		if r.flowGate() {
+			return
+		}
+		r.feedTree(path.Join(filepath, child.mf.Name), path.Join(rel, child.mf.Name), child, fc)
+	}
+}
@@ -0,0 +1,59 @@
+package recovery
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/clonercl/reposerver"
+	"github.com/morrocker/broadcast"
+	"github.com/morrocker/log"
+)
+
+func TestTreeCachePathPerCloud(t *testing.T) {
+	a := &Recovery{Data: &Data{Repository: "repo", Metafile: "mf", Version: 1}, CloudName: "a", LoginServer: "login"}
+	b := &Recovery{Data: &Data{Repository: "repo", Metafile: "mf", Version: 1}, CloudName: "b", LoginServer: "login"}
+	if a.treeCachePath() == b.treeCachePath() {
+		t.Error("recoveries of the same ids on different clouds share a cached tree")
+	}
+	b.CloudName, b.LoginServer = "a", "other"
+	if a.treeCachePath() == b.treeCachePath() {
+		t.Error("recoveries of the same ids on different login servers share a cached tree")
+	}
+}
+
+func TestFeedTreeSetsRel(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	folder := func(name string, children ...*cachedTree) *cachedTree {
+		return &cachedTree{Metafile: &reposerver.Metafile{Name: name, Type: reposerver.FolderType}, Children: children}
+	}
+	file := func(name string) *cachedTree {
+		return &cachedTree{Metafile: &reposerver.Metafile{Name: name, Type: reposerver.FileType}}
+	}
+	tree := fromCachedTree(folder("root", file("a.txt"), folder("docs", file("b.txt"))))
+
+	r := &Recovery{Data: &Data{ID: 1}, Status: Running, broadcaster: broadcast.New(), log: log.New()}
+	r.startTracker()
+	fc := make(chan *MetaTree, 10)
+	r.feedTree(dir, "", tree, fc)
+	close(fc)
+	got := make(map[string]string)
+	for mt := range fc {
+		got[mt.mf.Name] = mt.rel
+	}
+	want := map[string]string{"a.txt": "a.txt", "b.txt": "docs/b.txt"}
+	for name, rel := range want {
+		if got[name] != rel {
+			t.Errorf("file %s fed with rel %q, want %q", name, got[name], rel)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(dir, "docs")); err != nil {
+		t.Errorf("folder not created: %v", err)
+	}
+}
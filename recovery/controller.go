@@ -1,8 +1,17 @@
 package recovery
 
+import (
+	"sync/atomic"
+	"time"
+)
+
 func (r *Recovery) flowGate() bool {
 	l := r.broadcaster.Listen()
 	for {
+		if r.suspended() {
+			l.Close()
+			return true
+		}
 		switch r.Status {
 		case Running:
 			l.Close()
@@ -17,8 +26,21 @@ func (r *Recovery) flowGate() bool {
 	}
 }
 
+// suspended returns true once Suspend asked the execution to stop
+func (r *Recovery) suspended() bool {
+	return atomic.LoadInt32(&r.suspending) == 1
+}
+
+// stopped returns true if the execution was canceled or suspended, so its results are incomplete
+func (r *Recovery) stopped() bool {
+	return r.Status == Canceled || r.suspended()
+}
+
 func (r *Recovery) changeState(s State) {
 	r.Status = s
+	if s == Done || s == Canceled {
+		r.finishedAt = time.Now()
+	}
 	r.broadcaster.Broadcast()
 }
 func (r *Recovery) changeStep(s Step) {
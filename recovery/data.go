@@ -4,12 +4,14 @@ import (
 	"fmt"
 	"os"
 	"path"
+	"sync/atomic"
 	"time"
 
 	"github.com/morrocker/broadcast"
 	"github.com/morrocker/errors"
 	"github.com/morrocker/log"
 	"github.com/morrocker/recoveryserver/config"
+	"github.com/morrocker/recoveryserver/throttle"
 	"github.com/morrocker/utils"
 )
 
@@ -30,6 +32,8 @@ const (
 	Done
 	// Cancel Recovery to be removed
 	Canceled
+	// Suspending Recovery stopping for a server shutdown. It is Queued once its execution has ended
+	Suspending
 )
 
 const (
@@ -52,17 +56,76 @@ const (
 	Files
 )
 
+var stateNames = map[State]string{
+	Entry:      "Entry",
+	Queued:     "Queued",
+	Running:    "Running",
+	Paused:     "Paused",
+	Done:       "Done",
+	Canceled:   "Canceled",
+	Suspending: "Suspending",
+}
+
+var priorityNames = map[Priority]string{
+	VeryLowPr:  "VeryLow",
+	LowPr:      "Low",
+	MediumPr:   "Medium",
+	HighPr:     "High",
+	VeryHighPr: "VeryHigh",
+	UrgentPr:   "Urgent",
+}
+
+var stepNames = map[Step]string{
+	Metafiles: "Metafiles",
+	Files:     "Files",
+}
+
+func (s State) String() string {
+	if name, ok := stateNames[s]; ok {
+		return name
+	}
+	return fmt.Sprintf("State(%d)", int(s))
+}
+
+func (p Priority) String() string {
+	if name, ok := priorityNames[p]; ok {
+		return name
+	}
+	return fmt.Sprintf("Priority(%d)", int(p))
+}
+
+func (s Step) String() string {
+	if name, ok := stepNames[s]; ok {
+		return name
+	}
+	return fmt.Sprintf("Step(%d)", int(s))
+}
+
 // New returns a new Recovery object from the given recovery data
-func New(id int, data *Data, bc *broadcast.Broadcaster, cl config.Cloud) *Recovery {
+func New(id int, data *Data, bc *broadcast.Broadcaster, cloudName string, cl config.Cloud) *Recovery {
 	newRecovery := &Recovery{
 		Data:        data,
 		Priority:    MediumPr,
 		broadcaster: bc,
 	}
-	newRecovery.SetCloud(cl)
+	newRecovery.SetCloud(cloudName, cl)
 	return newRecovery
 }
 
+// Restore binds a recovery loaded from disk to the running broadcaster and its cloud. Recoveries that
+// were Running when the server went down come back Queued, while Paused ones stay Paused until started.
+func (r *Recovery) Restore(bc *broadcast.Broadcaster, cl config.Cloud) {
+	r.broadcaster = bc
+	r.SetCloud(r.CloudName, cl)
+	switch r.Status {
+	case Running, Suspending:
+		log.Info("Recovery #%d was running when the server stopped. Setting it as Queued", r.Data.ID)
+		r.Status = Queued
+	case Paused:
+		r.orphaned = true
+	}
+}
+
 // Pause stops a recovery execution
 func (r *Recovery) Pause() error {
 	log.Task("Pausing recovery %d", r.Data.ID)
@@ -78,11 +141,69 @@ func (r *Recovery) Pause() error {
 	}
 }
 
+// Suspend stops a running recovery and waits up to timeout for its execution to end. Workers stop at the
+// next block or file, leaving unfinished files out of the journal, and the journal and the recovery log are
+// closed. The recovery is Suspending until its execution ends and Queued after, so it resumes when the
+// server starts again. If timeout passes first it is left Suspending, and can't be run again meanwhile
+func (r *Recovery) Suspend(timeout time.Duration) error {
+	op := "recovery.Suspend()"
+	if r.Status != Running {
+		return errors.New(op, fmt.Sprintf("Recovery #%d is not running", r.Data.ID))
+	}
+	atomic.StoreInt32(&r.suspending, 1)
+	r.changeState(Suspending)
+	stopped := make(chan struct{})
+	go func() {
+		r.execution.Wait()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+		return nil
+	case <-time.After(timeout):
+		return errors.New(op, fmt.Sprintf("Recovery #%d did not stop after %s. It is still Suspending", r.Data.ID, timeout))
+	}
+}
+
+// endSuspend sets a suspended recovery as Queued once its execution has ended, and closes its log
+func (r *Recovery) endSuspend() {
+	if !r.suspended() {
+		return
+	}
+	r.changeState(Queued)
+	if r.tracker != nil {
+		r.tracker.Print()
+	}
+	if r.log != nil {
+		r.log.Notice("Recovery #%d suspended for server shutdown", r.Data.ID)
+		r.log.StopWriter()
+	}
+}
+
+// Claim sets a Queued recovery as Running right before its execution is started, so it can't be picked
+// again in the meantime. The state change is broadcast once Run starts
+func (r *Recovery) Claim() error {
+	if r.Status != Queued {
+		return errors.New("recovery.Claim()", fmt.Sprintf("Recovery #%d must be queued to run", r.Data.ID))
+	}
+	r.Status = Running
+	atomic.StoreInt32(&r.suspending, 0)
+	r.execution.Add(1)
+	return nil
+}
+
 // Start starts (or resumes) a recovery execution
 func (r *Recovery) Start() error {
 	log.Task("Running recovery #%d", r.Data.ID)
 	switch r.Status {
 	case Paused, Queued:
+		if r.orphaned {
+			// Paused before a restart, so there is no execution to resume. It goes back to the queue and
+			// the director runs it from scratch once a slot is free
+			r.orphaned = false
+			r.changeState(Queued)
+			return nil
+		}
 		r.changeState(Running)
 		return nil
 	default:
@@ -118,10 +239,16 @@ func (r *Recovery) PreDone() {
 	_, ft, _ := r.tracker.RawValues("files")
 	r.Data.TotalSize = st
 	r.Data.TotalFiles = ft
+	r.Data.FilteredSize = atomic.LoadInt64(&r.filteredSize)
+	r.Data.FilteredFiles = atomic.LoadInt64(&r.filteredNum)
+	r.Data.FilteredFolders = atomic.LoadInt64(&r.filteredDirs)
 	r.changeState(Done)
 	r.changeState(Entry)
 	time.Sleep(6 * time.Second)
 	log.Info("Recovery #%d precalculation finished. Total size: %s, Total Files: %d", r.Data.ID, utils.B2H(st), ft)
+	if r.Data.FilteredSize > 0 || r.Data.FilteredFiles > 0 || r.Data.FilteredFolders > 0 {
+		log.Info("Recovery #%d exclusions and filters left out at least %s in %d files and %d whole folders", r.Data.ID, utils.B2H(r.Data.FilteredSize), r.Data.FilteredFiles, r.Data.FilteredFolders)
+	}
 }
 
 // Cancel sets a recovery status as Cancel
@@ -131,8 +258,19 @@ func (r *Recovery) Cancel() error {
 	switch r.Status {
 	case Entry:
 		return errors.New(op, fmt.Sprintf("Recovery #%d is on Entry state Cancelling is irrelevant. Remove it if necesary", r.Data.ID))
+	case Suspending:
+		return errors.New(op, fmt.Sprintf("Recovery #%d is being suspended for a server shutdown", r.Data.ID))
 	case Done:
 		return errors.New(op, fmt.Sprintf("Recovery #%d Recovery is Done. Remove it first", r.Data.ID))
+	case Queued:
+		if r.Retry {
+			// The retry never started, so the recovery is left Done as it was
+			r.Retry = false
+			r.changeState(Done)
+			return nil
+		}
+		r.changeState(Canceled)
+		return nil
 	default:
 		r.changeState(Canceled)
 		return nil
@@ -146,6 +284,8 @@ func (r *Recovery) Queue() error {
 	switch r.Status {
 	case Running:
 		return errors.New(op, fmt.Sprintf("Recovery #%d is Running. Cancel it first", r.Data.ID))
+	case Suspending:
+		return errors.New(op, fmt.Sprintf("Recovery #%d is being suspended for a server shutdown", r.Data.ID))
 	case Done:
 		return errors.New(op, fmt.Sprintf("Recovery #%d is Done. Remove it first", r.Data.ID))
 	default:
@@ -166,11 +306,38 @@ func (r *Recovery) Unqueue() error {
 	}
 }
 
-func (r *Recovery) SetCloud(rc config.Cloud) {
+func (r *Recovery) SetCloud(name string, rc config.Cloud) {
+	r.CloudName = name
 	r.LoginServer = rc.FilesAddress
 	r.Data.ClonerKey = rc.ClonerKey
 	r.cloud = rc
-	r.RBS = NewRBS(rc)
+	r.RBS = NewRBS(name, rc)
+	r.RBS.OnMismatch(r.blockMismatch)
+	r.RBS.OnCacheLookup(r.blockCacheLookup)
+	if r.limiter == nil {
+		r.limiter = throttle.New(r.BandwidthLimit)
+	}
+	r.RBS.Throttle(throttle.Global, r.limiter)
+}
+
+// blockMismatch lists in the recovery log every block a store returned with the wrong content
+func (r *Recovery) blockMismatch(hash, address string) {
+	if r.log == nil || r.tracker == nil {
+		return
+	}
+	r.increaseErrors()
+	r.log.Alert("Block %s from store %s failed verification. Trying next store", hash, address)
+}
+
+// blockCacheLookup counts block cache lookups on the tracker "cache" gauge, whose current value is the hits
+func (r *Recovery) blockCacheLookup(hit bool) {
+	if r.tracker == nil {
+		return
+	}
+	r.tracker.IncreaseTotal("cache")
+	if hit {
+		r.tracker.IncreaseCurr("cache")
+	}
 }
 
 func (r *Recovery) SetOutput(dst string) {
@@ -189,15 +356,40 @@ func (r *Recovery) SetPriority(n int) error {
 	}
 	r.Priority = p
 	log.InfoV("Recovery #%d priority set to %d", r.Data.ID, p)
+	r.notify()
+	return nil
+}
+
+// SetBandwidthLimit caps the recovery block downloads in bytes per second. Zero removes the limit
+func (r *Recovery) SetBandwidthLimit(limit int64) error {
+	if limit < 0 {
+		return errors.New("recovery.SetBandwidthLimit()", "Bandwidth limit can't be negative")
+	}
+	r.BandwidthLimit = limit
+	if r.limiter != nil {
+		r.limiter.SetRate(limit)
+	}
+	if limit == 0 {
+		log.InfoV("Recovery #%d bandwidth limit removed", r.Data.ID)
+	} else {
+		log.InfoV("Recovery #%d bandwidth limit set to %sps", r.Data.ID, utils.B2H(limit))
+	}
+	r.notify()
 	return nil
 }
 
+// logPrefix names the recovery logs. It carries the recovery ID so logs of other recoveries of the same
+// disk are never mixed up with these
+func (r *Recovery) logPrefix() string {
+	return fmt.Sprintf("%s.%s.%s.%d", r.Data.User, r.Data.Machine, r.Data.Disk, r.Data.ID)
+}
+
 func (r *Recovery) initLogger() {
 	// GIVEN CHANGES TO THE TRACKER & LOGGER MAYBE CHANGES ARE NEEDED
 	op := "recovery.initLogger()"
 	Log := log.New()
 	now := time.Now().Format("2006-01-02T15h04m")
-	logName := fmt.Sprintf("%s.%s.%s.%s.log", r.Data.User, r.Data.Machine, r.Data.Disk, now)
+	logName := fmt.Sprintf("%s.%s.log", r.logPrefix(), now)
 	logPath := path.Join(config.Data.RcvrLogDir, r.Data.Org, logName)
 	if err := os.MkdirAll(path.Join(config.Data.RcvrLogDir, r.Data.Org), 0700); err != nil {
 		log.Error(op, err)
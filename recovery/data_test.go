@@ -0,0 +1,38 @@
+package recovery
+
+import (
+	"testing"
+	"time"
+
+	"github.com/morrocker/broadcast"
+)
+
+func TestSuspendTimeoutKeepsRecoveryOutOfQueue(t *testing.T) {
+	r := &Recovery{Data: &Data{ID: 1}, Status: Queued, broadcaster: broadcast.New()}
+	if err := r.Claim(); err != nil {
+		t.Fatal(err)
+	}
+	// The execution never ends on its own, like one whose workers are stuck writing
+	if err := r.Suspend(10 * time.Millisecond); err == nil {
+		t.Fatal("Suspend() returned before the execution ended")
+	}
+	if r.Status != Suspending {
+		t.Fatalf("status %v after a timed out suspend, want Suspending", r.Status)
+	}
+	if err := r.Claim(); err == nil {
+		t.Error("recovery claimed again while its execution is still running")
+	}
+	if err := r.Queue(); err == nil {
+		t.Error("recovery queued while its execution is still running")
+	}
+	if err := r.CanRemove(); err == nil {
+		t.Error("recovery removable while its execution is still running")
+	}
+
+	// What Run does once its workers are done
+	r.endSuspend()
+	r.execution.Done()
+	if r.Status != Queued {
+		t.Errorf("status %v once the execution ended, want Queued", r.Status)
+	}
+}
@@ -1,7 +1,10 @@
 package recovery
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
+	"io/ioutil"
 	"os"
 	"path"
 	"sync"
@@ -11,15 +14,11 @@ import (
 	"github.com/morrocker/errors"
 	"github.com/morrocker/log"
 	"github.com/morrocker/recoveryserver/config"
+	"github.com/morrocker/recoveryserver/metrics"
 	"github.com/morrocker/utils"
 	"golang.org/x/text/unicode/norm"
 )
 
-type fileQueue struct {
-	ToDo []*MetaTree
-	lock sync.Mutex
-}
-
 type bData struct {
 	id   int
 	hash string
@@ -29,199 +28,448 @@ type bData struct {
 type returnBlock struct {
 	id      int
 	content []byte
+	err     error
 }
 
-var fq fileQueue = fileQueue{}
+// errCanceled is returned for the blocks a stopped recovery no longer fetches
+var errCanceled = errors.NewSimple("block request canceled")
 
-func (r *Recovery) getFiles(mt *MetaTree) error {
+// getFiles walks the recovery tree and downloads every file as soon as its metafile is found
+func (r *Recovery) getFiles() error {
 	op := "recovery.getFiles()"
-	fc := make(chan *MetaTree)
+	fc := make(chan *MetaTree, config.Data.FileWorkers)
 	bc := make(chan bData)
 	wg := sync.WaitGroup{}
 	wg2 := sync.WaitGroup{}
 
-	r.log.Notice("Starting %d File workers", config.Data.FileWorkers)
-	for i := 0; i < config.Data.FileWorkers; i++ {
-		wg.Add(1)
-		go r.fileWorker(fc, &wg, bc)
+	dst := r.OutputPath()
+	var aw *archiveWriter
+	var ac chan *MetaTree
+	var archived sync.WaitGroup
+	if r.Archive != nil {
+		// An archive can't be appended to after a restart, so it is always written from scratch
+		if _, err := os.Stat(r.journalPath()); err == nil {
+			r.log.Alert("Recovery #%d archive can't be resumed. Every file will be downloaded again", r.Data.ID)
+			log.Alert("Recovery #%d archive can't be resumed. Every file will be downloaded again", r.Data.ID)
+		}
+		if err := os.Remove(r.journalPath()); err != nil && !os.IsNotExist(err) {
+			return errors.New(op, err)
+		}
+		if err := os.RemoveAll(r.stagingPath()); err != nil {
+			return errors.New(op, err)
+		}
+		if err := os.MkdirAll(path.Dir(dst), 0700); err != nil {
+			return errors.New(op, err)
+		}
+		if err := r.removeArchive(); err != nil {
+			return errors.Extend(op, err)
+		}
+		var passphrase string
+		if r.Archive.Encrypt {
+			var err error
+			if passphrase, err = r.ensurePassphrase(); err != nil {
+				return errors.Extend(op, err)
+			}
+		}
+		var err error
+		aw, err = newArchiveWriter(r.Archive, dst, r.stagingPath(), passphrase)
+		if err != nil {
+			return errors.Extend(op, err)
+		}
+		// Staged files hold plain content, so they never outlive the run, even a failed or canceled one
+		defer func() {
+			if err := os.RemoveAll(r.stagingPath()); err != nil {
+				r.log.Errorln(errors.New(op, err))
+			}
+		}()
+		log.Info("Writting files to %s archive %s", r.Archive.Format, dst)
+		dst = r.outputRoot()
+		ac = make(chan *MetaTree, config.Data.FileWorkers)
+		archived.Add(1)
+		go r.archiveFiles(aw, ac, &archived)
 	}
 
-	r.log.Notice("Starting %d Block workers", config.Data.FileWorkers)
-	for i := 0; i < config.Data.BlockWorkers; i++ {
-		wg2.Add(1)
-		go r.blockWorker(bc, &wg)
+	j, err := openJournal(r.journalPath())
+	if err != nil {
+		return errors.Extend(op, err)
 	}
+	r.journal = j
+	defer func() {
+		if err := r.journal.close(); err != nil {
+			r.log.Errorln(errors.Extend(op, err))
+		}
+	}()
 
-	dst := path.Join(r.OutputTo, r.Data.Org, r.Data.User, r.Data.Machine, r.Data.Disk)
 	r.log.Notice("Creating root directory " + dst)
-	if err := os.MkdirAll(dst, 0700); err != nil {
+	if err := os.MkdirAll(dst, outputDirMode()); err != nil {
 		return errors.New(op, errors.Extend(op, err))
 	}
-	log.Info("Writting files to " + dst)
-	r.createFileQueue(dst, mt)
+	if aw == nil {
+		log.Info("Writting files to " + dst)
+	}
 
-	time.Sleep(5 * time.Second)
+	r.log.Notice("Starting %d File workers", config.Data.FileWorkers)
+	for i := 0; i < config.Data.FileWorkers; i++ {
+		wg.Add(1)
+		go r.fileWorker(fc, &wg, bc, ac)
+	}
 
-	for _, tree := range fq.ToDo {
-		if r.flowGate() {
-			break
-		}
-		fc <- tree
+	r.log.Notice("Starting %d Block workers", config.Data.BlockWorkers)
+	for i := 0; i < config.Data.BlockWorkers; i++ {
+		wg2.Add(1)
+		go r.blockWorker(bc, &wg2)
 	}
 
-	time.Sleep(time.Second)
+	tree, err := r.loadTreeCache()
+	if err == nil {
+		r.log.Info("Using cached metafile tree")
+		root, rel := dst, ""
+		if tree.mf.Type != reposerver.FolderType {
+			root, rel = path.Join(dst, tree.mf.Name), tree.mf.Name
+		}
+		r.feedTree(root, rel, tree, fc)
+	} else {
+		r.log.InfoV("Not using a cached metafile tree: %s", err)
+		tree, err = r.GetRecoveryTree(dst, fc)
+		if err == nil {
+			r.cacheTree(tree)
+		}
+	}
 	close(fc)
+	if err == nil {
+		r.changeStep(Files)
+	}
 	wg.Wait()
-	fq = fileQueue{}
-	r.log.Noticeln("Files retrieval completed")
-	return nil
-}
-
-func (r *Recovery) createFileQueue(filepath string, mt *MetaTree) {
-	f := mt.mf
-	p := path.Join(filepath, f.Name)
-	if f.Type == reposerver.FolderType {
-		if f.Parent == "" {
-			p = filepath
-		} else {
-			if err := os.MkdirAll(norm.NFC.String(p), 0700); err != nil {
-				panic(fmt.Sprintf("could not create path '%s': %v\n", p, err))
-			}
-		}
-		for _, child := range mt.children {
-			if r.flowGate() {
-				break
-			}
-			r.createFileQueue(p, child)
+	r.senders.Wait()
+	close(bc)
+	wg2.Wait()
+	if aw != nil {
+		close(ac)
+		archived.Wait()
+	}
+	if err == nil && !r.stopped() {
+		r.finishManifest(dst, aw)
+		r.restoreDirAttrs(tree)
+	}
+	if aw != nil {
+		if err := r.closeArchive(aw); err != nil {
+			return errors.Extend(op, err)
 		}
-		return
 	}
-	mt.path = p
-	fq.addFile(mt)
-}
-
-func (f *fileQueue) addFile(mt *MetaTree) {
-	f.lock.Lock()
-	defer f.lock.Unlock()
-	f.ToDo = append(f.ToDo, mt)
+	if err != nil {
+		return errors.Extend(op, err)
+	}
+	r.log.Noticeln("Files retrieval completed")
+	return nil
 }
 
-func (r *Recovery) fileWorker(fc chan *MetaTree, wg *sync.WaitGroup, bc chan bData) {
-	op := "recovery.fileWorker()"
-Outer:
+// fileWorker downloads the files sent through fc. When ac is not nil every written file is then sent
+// through it to be archived
+func (r *Recovery) fileWorker(fc chan *MetaTree, wg *sync.WaitGroup, bc chan bData, ac chan *MetaTree) {
+	metrics.Workers.WithLabelValues("file").Inc()
+	defer metrics.Workers.WithLabelValues("file").Dec()
+	busy := metrics.BusyWorkers.WithLabelValues("file")
 	for mt := range fc {
+		// On cancel the channel is still drained so the tree walk is never left waiting to send
 		if r.flowGate() {
-			break
+			continue
 		}
-		// Checking if file exists and is already done
-		size := mt.mf.Size
-		path := mt.path
-		if fi, err := os.Stat(path); err == nil {
-			if fi.Size() == int64(size) {
-				r.updateTrackerCurrent(int64(size))
-				r.log.NoticeV("skipping file '%s'", path)
-				continue
-			}
+		busy.Inc()
+		written := r.recoverFile(mt, bc)
+		busy.Dec()
+		if written && ac != nil {
+			ac <- mt
 		}
+	}
+	wg.Done()
+}
 
-		r.log.Info("Recovering file %s [%s]", mt.path, utils.B2H(int64(size)))
-		// Getting file blocklist
-		blist, err := r.RBS.GetBlocksList(mt.mf.Hash, r.Data.User)
-		if err != nil {
-			r.increaseErrors()
-			r.log.ErrorlnV(errors.New(op, fmt.Sprintf("error could not create file '%s' because fileblock is unavailable", path)))
-			r.tracker.ChangeCurr("completedSize", mt.mf.Size)
-			continue
-		}
-		r.tracker.IncreaseCurr("blocks") // This is the fileblock
+// recoverFile downloads a single file, writes it to its path and records the outcome in the journal.
+// Returns true if the file was written, even if some of its blocks were missing
+func (r *Recovery) recoverFile(mt *MetaTree, bc chan bData) bool {
+	op := "recovery.recoverFile()"
+	// Checking if the journal shows the file as already done
+	size := mt.mf.Size
+	path := mt.path
+	if r.journal.completed(mt) {
+		r.updateTrackerCurrent(int64(size))
+		r.log.NoticeV("skipping file '%s'", path)
+		return false
+	}
 
-		// Creating recovery file
-		op := "recovery.fileWriter()"
-		f, err := os.Create(norm.NFC.String(path))
-		if err != nil {
-			r.increaseErrors()
-			log.Errorln(errors.New(op, fmt.Sprintf("error could not create file '%s' : %v\n", path, err)))
-			r.tracker.ChangeCurr("completedSize", mt.mf.Size)
-			continue
-		}
+	r.log.Info("Recovering file %s [%s]", mt.path, utils.B2H(int64(size)))
+	// Getting file blocklist
+	blist, err := r.RBS.GetBlocksList(mt.mf.Hash, r.Data.User)
+	if err != nil {
+		r.increaseErrors()
+		err = errors.New(op, fmt.Sprintf("error could not create file '%s' because its block list (fileblock %s) is unavailable: %v", path, mt.mf.Hash, err))
+		r.log.ErrorlnV(err)
+		r.recordFile(mt, fileOutcome{err: err})
+		r.tracker.ChangeCurr("completedSize", mt.mf.Size)
+		return false
+	}
+	r.tracker.IncreaseCurr("blocks") // This is the fileblock
 
-		ret := make(chan returnBlock)
-		blocksBuffer := make(map[int][]byte)
-		blocks := blist.Blocks
-		// Sending blocks to the blocks worker
-		go func() {
-			for i, hash := range blocks {
-				if r.flowGate() {
-					return
-				}
-				bc <- bData{id: i, hash: hash, ret: ret}
-			}
-		}()
+	// Creating recovery file. It is written under a temporary name and only replaces what is at its path
+	// once fully written, so a file delivered by an earlier run is never lost to a failed or canceled one
+	target := norm.NFC.String(path)
+	tmp := partialPath(target)
+	f, err := os.Create(tmp)
+	if err != nil {
+		r.increaseErrors()
+		err = errors.New(op, fmt.Sprintf("error could not create file '%s' : %v\n", path, err))
+		log.Errorln(err)
+		r.recordFile(mt, fileOutcome{err: err})
+		r.tracker.ChangeCurr("completedSize", mt.mf.Size)
+		return false
+	}
 
-		// Receiving blocks from blocksworkers and writting into file
-		for x := 0; x < len(blocks); x++ {
+	// ret can hold every block of the file so block workers never stall on an abandoned file
+	ret := make(chan returnBlock, len(blist.Blocks))
+	quit := make(chan struct{})
+	blocksBuffer := make(map[int]returnBlock)
+	blocks := blist.Blocks
+	policy := r.missingBlockPolicy()
+	var written, padded int64
+	var degraded error
+	var missing []string
+	var lengths []int
+	sum := sha256.New()
+	// Sending blocks to the blocks worker
+	r.senders.Add(1)
+	go func() {
+		defer r.senders.Done()
+		for i, hash := range blocks {
 			if r.flowGate() {
-				f.Close()
-				break Outer
+				return
 			}
-			content, ok := blocksBuffer[x]
-			if ok {
-				// log.Info("Block #%d is being written from buffer for %s", x, path[len(path)-20:])
-				if _, err := f.Write(content); err != nil {
-					r.increaseErrors()
-					r.log.Errorln(errors.New(op, fmt.Sprintf("error could not write content for block '%s' for file '%s': %v\n", blocks[x], path, err)))
-					r.tracker.ChangeCurr("completedSize", len(content))
-					continue Outer
-				}
-				r.tracker.ChangeCurr("completedSize", len(content))
-				r.tracker.ChangeCurr("size", len(content))
-				r.tracker.IncreaseCurr("blocks")
-				r.tracker.ChangeCurr("blocksBuffer", -1)
-				delete(blocksBuffer, x)
-				continue
+			select {
+			case bc <- bData{id: i, hash: hash, ret: ret}:
+			case <-quit:
+				return
 			}
+		}
+	}()
+	// discard closes the file and removes what was written of it
+	discard := func() {
+		f.Close()
+		if err := os.Remove(tmp); err != nil && !os.IsNotExist(err) {
+			r.log.Errorln(errors.New(op, err))
+		}
+	}
+	// abandon stops fetching the file blocks and discards it
+	abandon := func() {
+		close(quit)
+		r.tracker.ChangeCurr("blocksBuffer", -len(blocksBuffer))
+		r.tracker.ChangeCurr("completedSize", size-written)
+		discard()
+	}
+
+	// Receiving blocks from blocksworkers and writting into file
+	for x := 0; x < len(blocks); x++ {
+		if r.flowGate() {
+			// The file is left out of the journal so it is fetched again on the next run
+			discard()
+			return false
+		}
+		block, ok := blocksBuffer[x]
+		if ok {
+			r.tracker.ChangeCurr("blocksBuffer", -1)
+			delete(blocksBuffer, x)
+		} else {
 			for d := range ret {
 				if d.id == x {
-					// log.Info("Block #%d is being written directly for %s", x, path[len(path)-20:])
-					if _, err := f.Write(d.content); err != nil {
-						r.increaseErrors()
-						r.log.Errorln(errors.New(op, fmt.Sprintf("error could not write content for block '%s' for file '%s': %v\n", blocks[x], path[len(path)-20:], err)))
-						r.tracker.ChangeCurr("completedSize", len(d.content))
-						continue Outer
-					}
-					r.tracker.ChangeCurr("completedSize", len(d.content))
-					r.tracker.ChangeCurr("size", len(d.content))
-					r.tracker.IncreaseCurr("blocks")
+					block = d
 					break
 				}
 				r.checkBuffer()
-				blocksBuffer[d.id] = d.content
+				blocksBuffer[d.id] = d
 				r.tracker.IncreaseCurr("blocksBuffer")
 			}
 		}
-		r.tracker.IncreaseCurr("files")
-		// log.Info("Finishing file %s", path[len(path)-20:])
-		f.Close()
+		if block.err == errCanceled {
+			// Stopped while the block was in flight. Left out of the journal like above
+			close(quit)
+			r.tracker.ChangeCurr("blocksBuffer", -len(blocksBuffer))
+			discard()
+			return false
+		}
+		if block.err != nil {
+			missing = append(missing, blocks[x])
+			switch policy {
+			case MissingBlockFail, MissingBlockSkip:
+				abandon()
+				o := fileOutcome{blocks: missing, skipped: policy == MissingBlockSkip}
+				o.err = errors.New(op, fmt.Sprintf("file '%s' left out because block '%s' is unavailable", path, blocks[x]))
+				if o.skipped {
+					r.log.Alert("Skipping file %s: block %s is unavailable", path, blocks[x])
+				} else {
+					r.increaseErrors()
+					r.log.Errorln(o.err)
+				}
+				r.recordFile(mt, o)
+				return false
+			}
+			// Zero filled up to the length the block should have had, so the file keeps its size
+			block.content = make([]byte, expectedBlockSize(size, x))
+			padded += int64(len(block.content))
+			if degraded == nil {
+				degraded = errors.New(op, fmt.Sprintf("block '%s' was unavailable and got zero filled", blocks[x]))
+			}
+		}
+		if _, err := f.Write(block.content); err != nil {
+			r.increaseErrors()
+			err = errors.New(op, fmt.Sprintf("error could not write content for block '%s' for file '%s': %v\n", blocks[x], path, err))
+			r.log.Errorln(err)
+			r.recordFile(mt, fileOutcome{written: written, blocks: missing, padded: padded, err: err})
+			r.tracker.ChangeCurr("completedSize", len(block.content))
+			discard()
+			return false
+		}
+		sum.Write(block.content)
+		lengths = append(lengths, len(block.content))
+		written += int64(len(block.content))
+		r.tracker.ChangeCurr("completedSize", len(block.content))
+		r.tracker.ChangeCurr("size", len(block.content))
+		r.tracker.IncreaseCurr("blocks")
 	}
-	wg.Done()
+	r.tracker.IncreaseCurr("files")
+	// The content must be on disk before the journal calls the file complete, or a power loss could leave
+	// a file of the right size full of zeros marked as done
+	if err := f.Sync(); err != nil && degraded == nil {
+		degraded = errors.New(op, fmt.Sprintf("error could not sync file '%s': %v", path, err))
+	}
+	if err := f.Close(); err != nil && degraded == nil {
+		degraded = errors.New(op, fmt.Sprintf("error could not close file '%s': %v", path, err))
+	}
+	if err := os.Rename(tmp, target); err != nil {
+		r.increaseErrors()
+		err = errors.New(op, fmt.Sprintf("error could not move file '%s' into place: %v", path, err))
+		r.log.Errorln(err)
+		r.recordFile(mt, fileOutcome{written: written, blocks: missing, padded: padded, err: err})
+		discard()
+		return false
+	}
+	if err := r.restoreFileAttrs(mt); err != nil {
+		r.log.Alert("Could not restore attributes of file %s: %v", path, err)
+	}
+	// Read back from disk so what gets delivered is what was checked
+	if degraded == nil && written != mt.mf.Size {
+		degraded = errors.New(op, fmt.Sprintf("file '%s' failed verification: wrote %d bytes, expected %d", path, written, mt.mf.Size))
+	} else if degraded == nil {
+		if err := verifyFile(r.RBS.BlockHash, path, blocks, lengths); err != nil {
+			degraded = errors.New(op, fmt.Sprintf("file '%s' failed verification: %v", path, err))
+		}
+	}
+	if degraded != nil {
+		r.increaseErrors()
+		r.log.Errorln(degraded)
+	}
+	r.recordFile(mt, fileOutcome{written: written, sum: hex.EncodeToString(sum.Sum(nil)), blocks: missing, padded: padded, err: degraded})
+	return true
+}
+
+// partialPath returns the temporary name a file is written under until it is complete, in the same folder
+// so it is moved into place without copying
+func partialPath(p string) string {
+	dir, name := path.Split(p)
+	return dir + "." + name + ".part"
 }
 
 func (r *Recovery) blockWorker(dc chan bData, wg2 *sync.WaitGroup) {
+	metrics.Workers.WithLabelValues("block").Inc()
+	defer metrics.Workers.WithLabelValues("block").Dec()
+	busy := metrics.BusyWorkers.WithLabelValues("block")
 	for data := range dc {
+		// On cancel the channel is still drained and every block is answered, so no file worker is left
+		// waiting to send or to receive
 		if r.flowGate() {
-			break
+			data.ret <- returnBlock{data.id, nil, errCanceled}
+			continue
 		}
+		busy.Inc()
 		b, err := r.RBS.GetBlock(data.hash, r.Data.User)
+		busy.Dec()
 		if err != nil {
-			var zeroedBuffer = make([]byte, 1024*1000)
-			data.ret <- returnBlock{data.id, zeroedBuffer}
+			r.log.Errorln(errors.Extend("recovery.blockWorker()", err))
+			data.ret <- returnBlock{data.id, nil, err}
 			continue
 		}
-		data.ret <- returnBlock{data.id, b}
+		data.ret <- returnBlock{data.id, b, nil}
 	}
 	wg2.Done()
 }
 
+// archiveFiles moves every file sent through ac from the staging directory into the archive
+func (r *Recovery) archiveFiles(aw *archiveWriter, ac chan *MetaTree, wg *sync.WaitGroup) {
+	defer wg.Done()
+	for mt := range ac {
+		if err := aw.addFile(mt.path, metafileModTime(mt.mf)); err != nil {
+			r.increaseErrors()
+			err = errors.Extend("recovery.archiveFiles()", err)
+			r.log.Errorln(err)
+			r.recordFile(mt, fileOutcome{err: err})
+		}
+	}
+}
+
+// finishManifest writes the manifest and the list of padded files at the root of the output. Archives get
+// them both as first level entries and next to the archive file, so they can be checked before being extracted.
+// Encrypted archives only keep them inside, as they list every file name and hash in plain text
+func (r *Recovery) finishManifest(root string, aw *archiveWriter) {
+	op := "recovery.finishManifest()"
+	padded, err := r.writePaddedList(root)
+	if err != nil {
+		r.log.Errorln(errors.Extend(op, err))
+	}
+	manifest, err := r.writeManifest(root)
+	if err != nil {
+		r.log.Errorln(errors.Extend(op, err))
+		return
+	}
+	if aw == nil {
+		return
+	}
+	sidecars := map[string]string{manifest: r.OutputPath() + ".manifest.json"}
+	if padded != "" {
+		sidecars[padded] = r.OutputPath() + ".padded-files.txt"
+	}
+	for filename, sidecar := range sidecars {
+		if !aw.encrypt {
+			data, err := ioutil.ReadFile(filename)
+			if err != nil {
+				r.log.Errorln(errors.New(op, err))
+				continue
+			}
+			if err := writeSidecar(sidecar, data); err != nil {
+				r.log.Errorln(errors.New(op, err))
+			}
+		}
+		if err := aw.addFile(filename, time.Now()); err != nil {
+			r.log.Errorln(errors.Extend(op, err))
+		}
+	}
+}
+
+// closeArchive adds the folders left on the staging directory to the archive and closes it
+func (r *Recovery) closeArchive(aw *archiveWriter) error {
+	op := "recovery.closeArchive()"
+	if err := aw.addDirs(); err != nil {
+		r.log.Errorln(errors.Extend(op, err))
+	}
+	if err := aw.close(); err != nil {
+		return errors.Extend(op, err)
+	}
+	return nil
+}
+
+// recordFile writes the outcome of a file into the recovery journal
+func (r *Recovery) recordFile(mt *MetaTree, o fileOutcome) {
+	if err := r.journal.record(mt, o); err != nil {
+		r.log.Errorln(errors.Extend("recovery.recordFile()", err))
+	}
+}
+
 func (r *Recovery) checkBuffer() {
 	for {
 		c, t, err := r.tracker.RawValues("blocksBuffer")
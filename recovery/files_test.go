@@ -0,0 +1,158 @@
+package recovery
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/clonercl/blockserver/blocks"
+	"github.com/clonercl/reposerver"
+	"github.com/morrocker/broadcast"
+	"github.com/morrocker/log"
+)
+
+// mapStore answers block requests from a map of contents by hash
+type mapStore map[string][]byte
+
+func (s mapStore) Retrieve(hash, user string) ([]byte, error) {
+	if content, ok := s[hash]; ok {
+		return content, nil
+	}
+	return nil, os.ErrNotExist
+}
+
+func sha256Hex(content []byte) string {
+	sum := sha256.Sum256(content)
+	return hex.EncodeToString(sum[:])
+}
+
+func TestCancelWithBlocksInFlight(t *testing.T) {
+	dir, err := ioutil.TempDir("", "files")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	content := []byte("block content")
+	list, err := json.Marshal(BlocksList{Blocks: []string{sha256Hex(content), sha256Hex(content)}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	store := mapStore{sha256Hex(list): list, sha256Hex(content): content}
+	r := &Recovery{
+		Data:        &Data{ID: 1},
+		Status:      Running,
+		broadcaster: broadcast.New(),
+		log:         log.New(),
+		journal:     &journal{entries: make(map[string]journalEntry)},
+		RBS: &RBS{
+			Cloud:         "cancel-test",
+			BlockHash:     "sha256",
+			Addresses:     []string{"store"},
+			CurrentStores: []blocks.MasterStore{store},
+			health:        []*storeHealth{getStoreHealth("cancel-test", "store")},
+		},
+	}
+	r.startTracker()
+	mt := &MetaTree{
+		mf:   &reposerver.Metafile{ID: "a", Name: "file", Hash: sha256Hex(list), Size: int64(2 * len(content))},
+		path: filepath.Join(dir, "file"),
+	}
+	delivered := []byte("delivered by an earlier run")
+	if err := ioutil.WriteFile(mt.path, delivered, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// No block worker runs yet, so the first block is still unsent when the file starts waiting for it
+	bc := make(chan bData)
+	done := make(chan bool)
+	go func() { done <- r.recoverFile(mt, bc) }()
+	time.Sleep(50 * time.Millisecond)
+	r.Status = Canceled
+	r.broadcaster.Broadcast()
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go r.blockWorker(bc, &wg)
+	select {
+	case written := <-done:
+		if written {
+			t.Error("canceled file reported as written")
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("file left waiting for a block dropped after the cancel")
+	}
+	r.senders.Wait()
+	close(bc)
+	wg.Wait()
+	checkDelivered(t, mt.path, delivered)
+}
+
+// checkDelivered fails the test if the file at p is not the delivered content or its partial file was left behind
+func checkDelivered(t *testing.T, p string, delivered []byte) {
+	t.Helper()
+	if got, err := ioutil.ReadFile(p); err != nil || string(got) != string(delivered) {
+		t.Errorf("delivered file replaced by an unfinished one: %q, %v", got, err)
+	}
+	if _, err := os.Stat(partialPath(p)); !os.IsNotExist(err) {
+		t.Errorf("partial file left behind: %v", err)
+	}
+}
+
+func TestAbandonedRetryKeepsDeliveredFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "files")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	content := []byte("block content")
+	list, err := json.Marshal(BlocksList{Blocks: []string{sha256Hex(content), sha256Hex([]byte("lost block"))}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	store := mapStore{sha256Hex(list): list, sha256Hex(content): content}
+	r := &Recovery{
+		Data:          &Data{ID: 1},
+		Status:        Running,
+		MissingBlocks: "fail",
+		Retry:         true,
+		broadcaster:   broadcast.New(),
+		log:           log.New(),
+		journal:       &journal{entries: make(map[string]journalEntry)},
+		RBS: &RBS{
+			Cloud:         "abandon-test",
+			BlockHash:     "sha256",
+			Addresses:     []string{"store"},
+			CurrentStores: []blocks.MasterStore{store},
+			health:        []*storeHealth{getStoreHealth("abandon-test", "store")},
+		},
+	}
+	r.startTracker()
+	mt := &MetaTree{
+		mf:   &reposerver.Metafile{ID: "a", Name: "file", Hash: sha256Hex(list), Size: int64(2 * len(content))},
+		path: filepath.Join(dir, "file"),
+	}
+	delivered := []byte("delivered by an earlier run")
+	if err := ioutil.WriteFile(mt.path, delivered, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	bc := make(chan bData)
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go r.blockWorker(bc, &wg)
+	if r.recoverFile(mt, bc) {
+		t.Error("file with a missing block reported as written under the fail policy")
+	}
+	r.senders.Wait()
+	close(bc)
+	wg.Wait()
+	checkDelivered(t, mt.path, delivered)
+}
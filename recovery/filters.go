@@ -0,0 +1,205 @@
+package recovery
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/clonercl/reposerver"
+	"github.com/morrocker/errors"
+	"github.com/morrocker/log"
+)
+
+// Filters narrows down the files a recovery writes. Patterns are shell globs matched against the path
+// relative to the recovery root, or against the name alone when they have no slash. A pattern matching a
+// folder applies to everything under it. Extensions are given without the dot and compared ignoring case
+type Filters struct {
+	Include           []string   `json:"include,omitempty"`
+	Exclude           []string   `json:"exclude,omitempty"`
+	MinSize           int64      `json:"minSize,omitempty"`
+	MaxSize           int64      `json:"maxSize,omitempty"`
+	ModifiedAfter     *time.Time `json:"modifiedAfter,omitempty"`
+	ModifiedBefore    *time.Time `json:"modifiedBefore,omitempty"`
+	Extensions        []string   `json:"extensions,omitempty"`
+	ExcludeExtensions []string   `json:"excludeExtensions,omitempty"`
+}
+
+// Check returns an error if a pattern is malformed or a range is empty
+func (f *Filters) Check() error {
+	op := "recovery.Filters.Check()"
+	if f == nil {
+		return nil
+	}
+	for _, p := range append(append([]string{}, f.Include...), f.Exclude...) {
+		if _, err := path.Match(p, ""); err != nil {
+			return errors.New(op, fmt.Sprintf("Invalid pattern %q: %v", p, err))
+		}
+	}
+	if f.MinSize < 0 || f.MaxSize < 0 {
+		return errors.New(op, "Sizes can't be negative")
+	}
+	if f.MaxSize > 0 && f.MinSize > f.MaxSize {
+		return errors.New(op, "Minimum size is bigger than the maximum size")
+	}
+	if f.ModifiedAfter != nil && f.ModifiedBefore != nil && !f.ModifiedAfter.Before(*f.ModifiedBefore) {
+		return errors.New(op, "Modification date range is empty")
+	}
+	return nil
+}
+
+// matchPattern returns true if p matches rel or one of its parent folders
+func matchPattern(p, rel string) bool {
+	if !strings.Contains(p, "/") {
+		for _, name := range strings.Split(rel, "/") {
+			if ok, _ := path.Match(p, name); ok {
+				return true
+			}
+		}
+		return false
+	}
+	p = strings.Trim(p, "/")
+	for dir := rel; dir != "." && dir != "/" && dir != ""; dir = path.Dir(dir) {
+		if ok, _ := path.Match(p, dir); ok {
+			return true
+		}
+	}
+	return false
+}
+
+func hasExtension(name string, exts []string) bool {
+	ext := strings.TrimPrefix(strings.ToLower(path.Ext(name)), ".")
+	for _, e := range exts {
+		if strings.TrimPrefix(strings.ToLower(e), ".") == ext {
+			return true
+		}
+	}
+	return false
+}
+
+// skipFolder returns true if a folder and everything under it is left out of the recovery
+func (r *Recovery) skipFolder(mt *MetaTree) bool {
+	if r.Data.Exclusions[mt.mf.ID] {
+		return true
+	}
+	f := r.Data.Filters
+	if f == nil {
+		return false
+	}
+	for _, p := range f.Exclude {
+		if matchPattern(p, mt.rel) {
+			return true
+		}
+	}
+	return false
+}
+
+// skipFile returns true if a file is left out of the recovery
+func (r *Recovery) skipFile(mt *MetaTree) bool {
+	if r.Data.Exclusions[mt.mf.ID] {
+		return true
+	}
+	f := r.Data.Filters
+	if f == nil {
+		return false
+	}
+	for _, p := range f.Exclude {
+		if matchPattern(p, mt.rel) {
+			return true
+		}
+	}
+	if len(f.Include) > 0 {
+		included := false
+		for _, p := range f.Include {
+			if matchPattern(p, mt.rel) {
+				included = true
+				break
+			}
+		}
+		if !included {
+			return true
+		}
+	}
+	size := mt.mf.Size
+	if size < f.MinSize || (f.MaxSize > 0 && size > f.MaxSize) {
+		return true
+	}
+	// Files without a known modification time are kept, since the range can't be checked
+	if t := metafileModTime(mt.mf); !t.IsZero() {
+		if f.ModifiedAfter != nil && t.Before(*f.ModifiedAfter) {
+			return true
+		}
+		if f.ModifiedBefore != nil && !t.Before(*f.ModifiedBefore) {
+			return true
+		}
+	}
+	if len(f.Extensions) > 0 && !hasExtension(mt.mf.Name, f.Extensions) {
+		return true
+	}
+	return hasExtension(mt.mf.Name, f.ExcludeExtensions)
+}
+
+// skipChild returns true if a child found on the tree walk is left out, counting what it removes. Folders
+// are never walked, which is the point of pruning them, so they count as a single folder with the size their
+// metafile reports and the files under them are left uncounted
+func (r *Recovery) skipChild(mt *MetaTree) bool {
+	var skip bool
+	if mt.mf.Type == reposerver.FolderType {
+		skip = r.skipFolder(mt)
+		if skip {
+			atomic.AddInt64(&r.filteredDirs, 1)
+		}
+	} else {
+		skip = r.skipFile(mt)
+		if skip {
+			atomic.AddInt64(&r.filteredNum, 1)
+		}
+	}
+	if skip {
+		atomic.AddInt64(&r.filteredSize, mt.mf.Size)
+		r.log.InfoV("Leaving out %s", mt.rel)
+	}
+	return skip
+}
+
+// filtersKey identifies the exclusions and filters of the recovery, so trees walked with different ones
+// are cached apart. Empty when there are none
+func (r *Recovery) filtersKey() string {
+	if len(r.Data.Exclusions) == 0 && r.Data.Filters == nil {
+		return ""
+	}
+	var ids []string
+	for id, ok := range r.Data.Exclusions {
+		if ok {
+			ids = append(ids, id)
+		}
+	}
+	sort.Strings(ids)
+	data, _ := json.Marshal(struct {
+		Exclusions []string `json:"exclusions"`
+		Filters    *Filters `json:"filters"`
+	}{ids, r.Data.Filters})
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:8])
+}
+
+// SetFilters replaces the recovery filters. Nil removes them
+func (r *Recovery) SetFilters(f *Filters) error {
+	op := "recovery.SetFilters()"
+	if err := f.Check(); err != nil {
+		return errors.Extend(op, err)
+	}
+	switch r.Status {
+	case Running, Paused, Suspending:
+		return errors.New(op, fmt.Sprintf("Recovery #%d is %s. Cancel it first", r.Data.ID, r.Status))
+	}
+	r.Data.Filters = f
+	log.InfoV("Recovery #%d filters updated", r.Data.ID)
+	r.notify()
+	return nil
+}
@@ -0,0 +1,112 @@
+package recovery
+
+import (
+	"path"
+	"testing"
+	"time"
+
+	"github.com/clonercl/reposerver"
+)
+
+func TestMatchPattern(t *testing.T) {
+	for _, tc := range []struct {
+		p, rel string
+		want   bool
+	}{
+		{"*.tmp", "a.tmp", true},
+		{"*.tmp", "docs/a.tmp", true},
+		{"*.tmp", "docs/a.txt", false},
+		{"cache", "home/cache/x.bin", true},
+		{"cache", "home/caches/x.bin", false},
+		{"home/cache", "home/cache/x.bin", true},
+		{"/home/cache/", "home/cache/sub/x.bin", true},
+		{"home/*/x.bin", "home/cache/x.bin", true},
+		{"cache/x.bin", "home/cache/x.bin", false},
+		{"home/cache", "other/home/cache", false},
+	} {
+		if got := matchPattern(tc.p, tc.rel); got != tc.want {
+			t.Errorf("matchPattern(%q, %q) = %v, want %v", tc.p, tc.rel, got, tc.want)
+		}
+	}
+}
+
+func testFile(id, rel string, size int64) *MetaTree {
+	return &MetaTree{mf: &reposerver.Metafile{ID: id, Name: path.Base(rel), Size: size, Type: reposerver.FileType}, rel: rel}
+}
+
+func TestSkipFile(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		filters *Filters
+		mt      *MetaTree
+		want    bool
+	}{
+		{"no filters", nil, testFile("a", "docs/a.txt", 10), false},
+		{"excluded by id", nil, testFile("x", "docs/x.txt", 10), true},
+		{"exclude pattern", &Filters{Exclude: []string{"*.txt"}}, testFile("a", "docs/a.txt", 10), true},
+		{"exclude parent", &Filters{Exclude: []string{"docs"}}, testFile("a", "docs/a.txt", 10), true},
+		{"include match", &Filters{Include: []string{"docs"}}, testFile("a", "docs/a.txt", 10), false},
+		{"include miss", &Filters{Include: []string{"pics"}}, testFile("a", "docs/a.txt", 10), true},
+		{"exclude wins", &Filters{Include: []string{"docs"}, Exclude: []string{"*.txt"}}, testFile("a", "docs/a.txt", 10), true},
+		{"below min", &Filters{MinSize: 11}, testFile("a", "a.txt", 10), true},
+		{"at min", &Filters{MinSize: 10}, testFile("a", "a.txt", 10), false},
+		{"above max", &Filters{MaxSize: 9}, testFile("a", "a.txt", 10), true},
+		{"at max", &Filters{MaxSize: 10}, testFile("a", "a.txt", 10), false},
+		{"extension match", &Filters{Extensions: []string{".TXT"}}, testFile("a", "a.txt", 10), false},
+		{"extension miss", &Filters{Extensions: []string{"jpg"}}, testFile("a", "a.txt", 10), true},
+		{"excluded extension", &Filters{ExcludeExtensions: []string{"txt"}}, testFile("a", "a.TXT", 10), true},
+		{"unknown time kept", &Filters{ModifiedAfter: &time.Time{}}, testFile("a", "a.txt", 10), false},
+	} {
+		r := &Recovery{Data: &Data{Exclusions: map[string]bool{"x": true}, Filters: tc.filters}}
+		if got := r.skipFile(tc.mt); got != tc.want {
+			t.Errorf("%s: skipFile(%q) = %v, want %v", tc.name, tc.mt.rel, got, tc.want)
+		}
+	}
+}
+
+func TestFiltersCheck(t *testing.T) {
+	now := time.Now()
+	later := now.Add(time.Hour)
+	for _, tc := range []struct {
+		name    string
+		filters *Filters
+		ok      bool
+	}{
+		{"nil", nil, true},
+		{"empty", &Filters{}, true},
+		{"valid", &Filters{Include: []string{"docs/*"}, Exclude: []string{"*.tmp"}, MinSize: 1, MaxSize: 10, ModifiedAfter: &now, ModifiedBefore: &later}, true},
+		{"bad include", &Filters{Include: []string{"[docs"}}, false},
+		{"bad exclude", &Filters{Exclude: []string{"a\\"}}, false},
+		{"negative min", &Filters{MinSize: -1}, false},
+		{"negative max", &Filters{MaxSize: -1}, false},
+		{"min over max", &Filters{MinSize: 11, MaxSize: 10}, false},
+		{"min without max", &Filters{MinSize: 11}, true},
+		{"empty date range", &Filters{ModifiedAfter: &now, ModifiedBefore: &now}, false},
+		{"reversed date range", &Filters{ModifiedAfter: &later, ModifiedBefore: &now}, false},
+	} {
+		if err := tc.filters.Check(); (err == nil) != tc.ok {
+			t.Errorf("%s: Check() = %v, want ok %v", tc.name, err, tc.ok)
+		}
+	}
+}
+
+func TestSkipFileByDate(t *testing.T) {
+	after := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	before := time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)
+	r := &Recovery{Data: &Data{Filters: &Filters{ModifiedAfter: &after, ModifiedBefore: &before}}}
+	for _, tc := range []struct {
+		mtime time.Time
+		want  bool
+	}{
+		{time.Date(2019, 6, 1, 0, 0, 0, 0, time.UTC), true},
+		{after, false},
+		{time.Date(2020, 6, 1, 0, 0, 0, 0, time.UTC), false},
+		{before, true},
+		{time.Time{}, false},
+	} {
+		mt := &MetaTree{mf: &reposerver.Metafile{ID: "a", Name: "a.txt", Type: reposerver.FileType, Mtime: tc.mtime}, rel: "a.txt"}
+		if got := r.skipFile(mt); got != tc.want {
+			t.Errorf("skipFile() = %v for a file modified on %s, want %v", got, tc.mtime, tc.want)
+		}
+	}
+}
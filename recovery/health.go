@@ -0,0 +1,230 @@
+package recovery
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/morrocker/recoveryserver/config"
+	"github.com/morrocker/recoveryserver/metrics"
+)
+
+// latencySamples is how many of the latest successful requests latency percentiles are taken from
+const latencySamples = 128
+
+// latencyWeight is how much every new sample moves a store smoothed latency and error rate
+const latencyWeight = 0.2
+
+// StoreStats describes the health of a single store as seen by every recovery using it
+type StoreStats struct {
+	Cloud     string     `json:"cloud"`
+	Address   string     `json:"address"`
+	Requests  int64      `json:"requests"`
+	Errors    int64      `json:"errors"`
+	ErrorRate float64    `json:"errorRate"`
+	Latency   string     `json:"latency"`
+	Open      bool       `json:"open"`
+	OpenUntil *time.Time `json:"openUntil,omitempty"`
+	LastError string     `json:"lastError,omitempty"`
+}
+
+// storeHealth tracks latency and errors of a store and trips a circuit breaker after consecutive failures.
+// While open the store is skipped until its cool-down expires, then a single probe request decides if
+// it closes again or stays open for a longer cool-down
+type storeHealth struct {
+	lock      sync.Mutex
+	cloud     string
+	address   string
+	requests  int64
+	errors    int64
+	errorRate float64
+	latency   time.Duration
+	failures  int
+	openUntil time.Time
+	cooldown  time.Duration
+	probing   bool
+	lastError string
+	samples   [latencySamples]time.Duration
+	sampled   int
+}
+
+var (
+	storesLock sync.Mutex
+	stores     = make(map[string]*storeHealth)
+)
+
+// getStoreHealth returns the shared health tracker of a cloud store, creating it if needed
+func getStoreHealth(cloud, address string) *storeHealth {
+	storesLock.Lock()
+	defer storesLock.Unlock()
+	key := cloud + "|" + address
+	h, ok := stores[key]
+	if !ok {
+		h = &storeHealth{cloud: cloud, address: address}
+		stores[key] = h
+	}
+	return h
+}
+
+// StoresHealth returns the health of every store used so far, sorted by cloud and address
+func StoresHealth() []StoreStats {
+	storesLock.Lock()
+	out := []StoreStats{}
+	for _, h := range stores {
+		out = append(out, h.stats())
+	}
+	storesLock.Unlock()
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].Cloud != out[j].Cloud {
+			return out[i].Cloud < out[j].Cloud
+		}
+		return out[i].Address < out[j].Address
+	})
+	return out
+}
+
+// storeFailures returns how many consecutive failures open a store circuit. Defaults to 5
+func storeFailures() int {
+	if config.Data.StoreFailures < 1 {
+		return 5
+	}
+	return config.Data.StoreFailures
+}
+
+// storeCooldown returns how long a store is skipped after its circuit opens. Defaults to 30 seconds
+func storeCooldown() time.Duration {
+	if config.Data.StoreCooldown < 1 {
+		return 30 * time.Second
+	}
+	return time.Duration(config.Data.StoreCooldown) * time.Second
+}
+
+// maxStoreCooldown caps the cool-down growth of a store that keeps failing its probes
+const maxStoreCooldown = 10 * time.Minute
+
+func (h *storeHealth) success(latency time.Duration) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	h.requests++
+	if h.latency == 0 {
+		h.latency = latency
+	} else {
+		h.latency = time.Duration(float64(h.latency)*(1-latencyWeight) + float64(latency)*latencyWeight)
+	}
+	h.errorRate = h.errorRate * (1 - latencyWeight)
+	h.samples[h.sampled%latencySamples] = latency
+	h.sampled++
+	h.failures = 0
+	h.probing = false
+	h.cooldown = 0
+	h.openUntil = time.Time{}
+	metrics.StoreLatency.WithLabelValues(h.cloud, h.address).Set(h.latency.Seconds())
+	metrics.StoreCircuitOpen.WithLabelValues(h.cloud, h.address).Set(0)
+}
+
+// answered records a request the store answered without serving the block, such as a missing block. It
+// closes the circuit like a success but leaves the latency alone
+func (h *storeHealth) answered() {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	h.requests++
+	h.errorRate = h.errorRate * (1 - latencyWeight)
+	h.failures = 0
+	h.probing = false
+	h.cooldown = 0
+	h.openUntil = time.Time{}
+	metrics.StoreCircuitOpen.WithLabelValues(h.cloud, h.address).Set(0)
+}
+
+func (h *storeHealth) failure(err string) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	h.requests++
+	h.errors++
+	h.errorRate = h.errorRate*(1-latencyWeight) + latencyWeight
+	h.failures++
+	h.lastError = err
+	if h.probing || h.failures >= storeFailures() {
+		switch {
+		case h.cooldown == 0:
+			h.cooldown = storeCooldown()
+		case h.probing:
+			h.cooldown *= 2
+			if h.cooldown > maxStoreCooldown {
+				h.cooldown = maxStoreCooldown
+			}
+		}
+		h.openUntil = time.Now().Add(h.cooldown)
+		h.probing = false
+		metrics.StoreCircuitOpen.WithLabelValues(h.cloud, h.address).Set(1)
+	}
+}
+
+// isOpen returns true while the store circuit is open, whether or not its cool-down expired
+func (h *storeHealth) isOpen() bool {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	return !h.openUntil.IsZero()
+}
+
+// allow returns true if a request may be sent to the store. Once an open store cool-down expires only
+// one probe request is allowed until it answers
+func (h *storeHealth) allow() bool {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	if h.openUntil.IsZero() {
+		return true
+	}
+	if time.Now().Before(h.openUntil) || h.probing {
+		return false
+	}
+	h.probing = true
+	return true
+}
+
+// percentile returns the latency under which the p fraction of the latest requests answered. ok is false
+// until the store has hedgeMinSamples samples
+func (h *storeHealth) percentile(p float64) (d time.Duration, ok bool) {
+	h.lock.Lock()
+	n := h.sampled
+	if n > latencySamples {
+		n = latencySamples
+	}
+	if n < hedgeMinSamples {
+		h.lock.Unlock()
+		return 0, false
+	}
+	samples := make([]time.Duration, n)
+	copy(samples, h.samples[:n])
+	h.lock.Unlock()
+	sort.Slice(samples, func(i, j int) bool { return samples[i] < samples[j] })
+	return samples[int(p*float64(n-1))], true
+}
+
+// score ranks stores for selection. Lower is better. Errors also add a flat second so failing stores
+// rank behind untried ones
+func (h *storeHealth) score() float64 {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	return float64(h.latency)*(1+10*h.errorRate) + h.errorRate*float64(time.Second)
+}
+
+func (h *storeHealth) stats() StoreStats {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	s := StoreStats{
+		Cloud:     h.cloud,
+		Address:   h.address,
+		Requests:  h.requests,
+		Errors:    h.errors,
+		ErrorRate: h.errorRate,
+		Latency:   h.latency.Round(time.Millisecond).String(),
+		Open:      !h.openUntil.IsZero(),
+		LastError: h.lastError,
+	}
+	if s.Open {
+		until := h.openUntil
+		s.OpenUntil = &until
+	}
+	return s
+}
@@ -0,0 +1,55 @@
+package recovery
+
+import (
+	"errors"
+	"net"
+	"net/url"
+	"testing"
+)
+
+func TestMissingBlock(t *testing.T) {
+	for msg, want := range map[string]bool{
+		"block abc not found":                 true,
+		"status 404":                          true,
+		"unexpected status code: 404":         true,
+		"404 Not Found":                       true,
+		"open /blocks/abc: no such file":      true,
+		"dial tcp 10.0.0.1:4000: i/o timeout": false,
+		"status 500: internal server error":   false,
+		"connection reset by peer":            false,
+		"Get http://store:8404/blocks/ab404cd: dial tcp 10.0.0.1:8404: connection refused": false,
+		"dial tcp: lookup store: no such host":                                             false,
+	} {
+		if got := missingBlock(errors.New(msg)); got != want {
+			t.Errorf("missingBlock(%q) = %v, want %v", msg, got, want)
+		}
+	}
+}
+
+func TestMissingBlockNeverNetworkError(t *testing.T) {
+	// A network error is a transport failure whatever its message says
+	err := &url.Error{
+		Op:  "Get",
+		URL: "http://store/blocks/4040404 not found",
+		Err: &net.OpError{Op: "dial", Net: "tcp", Err: errors.New("connection refused")},
+	}
+	if missingBlock(err) {
+		t.Errorf("missingBlock(%q) = true for a dial error", err)
+	}
+}
+
+func TestMissingBlocksKeepCircuitClosed(t *testing.T) {
+	h := &storeHealth{cloud: "test", address: "missing"}
+	for i := 0; i < storeFailures()*2; i++ {
+		h.answered()
+	}
+	if h.isOpen() {
+		t.Fatal("circuit opened after missing blocks only")
+	}
+	for i := 0; i < storeFailures(); i++ {
+		h.failure("timeout")
+	}
+	if !h.isOpen() {
+		t.Fatalf("circuit still closed after %d transport failures", storeFailures())
+	}
+}
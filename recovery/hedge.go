@@ -0,0 +1,155 @@
+package recovery
+
+import (
+	"sync"
+	"time"
+
+	"github.com/morrocker/recoveryserver/config"
+	"github.com/morrocker/recoveryserver/metrics"
+)
+
+// hedgeMinSamples is how many latency samples a store needs before its requests are hedged
+const hedgeMinSamples = 20
+
+// hedgeSettings configures the hedged block requests of a cloud
+type hedgeSettings struct {
+	enabled    bool
+	percentile float64
+	budget     *hedgeBudget
+}
+
+// hedgeBudget caps the hedged requests of a cloud to a ratio of its block requests. Counts are halved
+// every hedgeBudgetWindow requests so the cap follows recent traffic
+type hedgeBudget struct {
+	lock     sync.Mutex
+	ratio    float64
+	requests float64
+	hedged   float64
+}
+
+const hedgeBudgetWindow = 10000
+
+var (
+	budgetsLock sync.Mutex
+	budgets     = make(map[string]*hedgeBudget)
+)
+
+// newHedgeSettings reads the hedging settings of a cloud. Hedging needs at least two stores
+func newHedgeSettings(name string, c config.Cloud) hedgeSettings {
+	if !c.Hedge || len(c.Stores) < 2 {
+		return hedgeSettings{}
+	}
+	percentile := c.HedgePercentile
+	if percentile <= 0 || percentile >= 1 {
+		percentile = 0.95
+	}
+	ratio := c.HedgeMaxRatio
+	if ratio <= 0 {
+		ratio = 0.05
+	}
+	budgetsLock.Lock()
+	defer budgetsLock.Unlock()
+	b, ok := budgets[name]
+	if !ok {
+		b = &hedgeBudget{}
+		budgets[name] = b
+	}
+	b.lock.Lock()
+	b.ratio = ratio
+	b.lock.Unlock()
+	return hedgeSettings{enabled: true, percentile: percentile, budget: b}
+}
+
+// request counts a block request
+func (b *hedgeBudget) request() {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.requests++
+	if b.requests > hedgeBudgetWindow {
+		b.requests /= 2
+		b.hedged /= 2
+	}
+}
+
+// take returns true, counting a hedged request, if the cloud is still under its hedging ratio
+func (b *hedgeBudget) take() bool {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if b.hedged+1 > b.ratio*b.requests {
+		return false
+	}
+	b.hedged++
+	return true
+}
+
+// hedgeCandidate returns the first store on order that was not tried yet and has its circuit closed, or -1
+func (c *RBS) hedgeCandidate(order []int, tried map[int]bool) int {
+	for _, j := range order {
+		if !tried[j] && !c.health[j].isOpen() {
+			return j
+		}
+	}
+	return -1
+}
+
+// hedgedFetch requests a block to store i. If hedge is a valid store and i takes longer than its latency
+// percentile, the block is also requested to hedge and the first valid answer wins. The caller marks hedge
+// as tried, so whenever i fails the block is always requested to hedge too
+func (c *RBS) hedgedFetch(i, hedge int, hash, user string) fetchResult {
+	if hedge < 0 {
+		return c.fetch(i, hash, user)
+	}
+	// fallback requests the block to the hedge store once store i failed without it being raced
+	fallback := func(r fetchResult) fetchResult {
+		if r.err == nil {
+			return r
+		}
+		next := c.fetch(hedge, hash, user)
+		next.mismatched = next.mismatched || r.mismatched
+		return next
+	}
+	c.hedge.budget.request()
+	delay, ok := c.health[i].percentile(c.hedge.percentile)
+	if !ok {
+		return fallback(c.fetch(i, hash, user))
+	}
+
+	results := make(chan fetchResult, 2)
+	go func() {
+		results <- c.fetch(i, hash, user)
+	}()
+	timer := time.NewTimer(delay)
+	select {
+	case r := <-results:
+		timer.Stop()
+		// The first store already failed, so the hedge store is just the next one to try
+		return fallback(r)
+	case <-timer.C:
+	}
+	if !c.hedge.budget.take() {
+		return fallback(<-results)
+	}
+
+	metrics.HedgedRequests.WithLabelValues(c.Cloud).Inc()
+	go func() {
+		r := c.fetch(hedge, hash, user)
+		if r.err == nil {
+			r.hedged = true
+		}
+		results <- r
+	}()
+	var mismatched bool
+	var last fetchResult
+	for pending := 2; pending > 0; pending-- {
+		last = <-results
+		mismatched = mismatched || last.mismatched
+		if last.err == nil {
+			if last.hedged {
+				metrics.HedgeWins.WithLabelValues(c.Cloud).Inc()
+			}
+			return last
+		}
+	}
+	last.mismatched = mismatched
+	return last
+}
@@ -0,0 +1,65 @@
+package recovery
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/clonercl/blockserver/blocks"
+)
+
+// fakeStore answers every block request after delay, with content or with err
+type fakeStore struct {
+	delay   time.Duration
+	content []byte
+	err     error
+	calls   int
+}
+
+func (s *fakeStore) Retrieve(hash, user string) ([]byte, error) {
+	s.calls++
+	time.Sleep(s.delay)
+	return s.content, s.err
+}
+
+func TestHedgeUsedWhenPrimaryFailsWithoutBudget(t *testing.T) {
+	content := []byte("block content")
+	sum := sha256.Sum256(content)
+	hash := hex.EncodeToString(sum[:])
+
+	primary := &fakeStore{delay: 20 * time.Millisecond, err: errors.New("i/o timeout")}
+	hedge := &fakeStore{content: content}
+	c := &RBS{
+		Cloud:         "hedge-test",
+		BlockHash:     "sha256",
+		Addresses:     []string{"primary", "hedge"},
+		CurrentStores: []blocks.MasterStore{primary, hedge},
+		health:        []*storeHealth{getStoreHealth("hedge-test", "primary"), getStoreHealth("hedge-test", "hedge")},
+		// A fresh budget has no requests yet, so no request can be hedged
+		hedge: hedgeSettings{enabled: true, percentile: 0.5, budget: &hedgeBudget{ratio: 0.05}},
+	}
+	// The primary answers faster so it is picked first, and its percentile is well under its delay
+	for i := 0; i < hedgeMinSamples; i++ {
+		c.health[0].success(time.Millisecond)
+		c.health[1].success(50 * time.Millisecond)
+	}
+
+	start := time.Now()
+	got, err := c.GetBlock(hash, "user")
+	elapsed := time.Since(start)
+	if err != nil {
+		t.Fatalf("GetBlock() failed: %v", err)
+	}
+	if string(got) != string(content) {
+		t.Errorf("GetBlock() = %q, want %q", got, content)
+	}
+	// Without falling back on the hedge store the block is only found on a second pass over the stores
+	if elapsed >= retryDelay {
+		t.Errorf("GetBlock() took %s, the hedge store was left for a second pass", elapsed)
+	}
+	if primary.calls != 1 || hedge.calls != 1 {
+		t.Errorf("stores were called %d and %d times, want 1 and 1", primary.calls, hedge.calls)
+	}
+}
@@ -0,0 +1,174 @@
+package recovery
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"sync"
+	"time"
+
+	"github.com/morrocker/errors"
+	"github.com/morrocker/recoveryserver/config"
+	"golang.org/x/text/unicode/norm"
+)
+
+// journal records every file a recovery has finished so a stopped or crashed recovery can resume
+// exactly where it left off
+type journal struct {
+	file    *os.File
+	entries map[string]journalEntry
+	lock    sync.Mutex
+}
+
+// journalEntry stores the outcome of writing a single file
+type journalEntry struct {
+	Path    string    `json:"path"`
+	ID      string    `json:"id"`
+	Hash    string    `json:"hash"`
+	Size    int64     `json:"size"`
+	Written int64     `json:"written"`
+	SHA256  string    `json:"sha256,omitempty"`
+	Error   string    `json:"error,omitempty"`
+	Blocks  []string  `json:"blocks,omitempty"`
+	Padded  int64     `json:"padded,omitempty"`
+	Skipped bool      `json:"skipped,omitempty"`
+	Folder  bool      `json:"folder,omitempty"`
+	Time    time.Time `json:"time"`
+}
+
+func (r *Recovery) journalPath() string {
+	return path.Join(config.Data.JournalDir, fmt.Sprintf("%d.journal", r.Data.ID))
+}
+
+// openJournal loads a journal file, creating it if needed, and leaves it open for appending
+func openJournal(filename string) (*journal, error) {
+	op := "recovery.openJournal()"
+	j := &journal{entries: make(map[string]journalEntry)}
+
+	f, err := os.OpenFile(filename, os.O_CREATE|os.O_RDWR|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, errors.New(op, err)
+	}
+	if err := readJournal(f, j.entries); err != nil {
+		f.Close()
+		return nil, errors.Extend(op, err)
+	}
+	j.file = f
+	return j, nil
+}
+
+// readJournal loads the latest entry of every file from a journal into entries
+func readJournal(rd io.Reader, entries map[string]journalEntry) error {
+	scanner := bufio.NewScanner(rd)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		var e journalEntry
+		// A crash can leave a half written last line. It is ignored and the file gets fetched again
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			continue
+		}
+		entries[e.Path] = e
+	}
+	if err := scanner.Err(); err != nil {
+		return errors.New("recovery.readJournal()", err)
+	}
+	return nil
+}
+
+// completed returns true if the journal shows the file as fully written and the file on disk agrees
+func (j *journal) completed(mt *MetaTree) bool {
+	j.lock.Lock()
+	e, ok := j.entries[mt.path]
+	j.lock.Unlock()
+	if !ok || e.Error != "" {
+		return false
+	}
+	if e.ID != mt.mf.ID || e.Hash != mt.mf.Hash || e.Size != mt.mf.Size || e.Written != e.Size {
+		return false
+	}
+	fi, err := os.Stat(norm.NFC.String(mt.path))
+	if err != nil || fi.Size() != e.Written {
+		return false
+	}
+	return true
+}
+
+// failed returns true if the latest entry for p records an error
+func (j *journal) failed(p string) bool {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+	e, ok := j.entries[p]
+	return ok && e.Error != ""
+}
+
+// fileOutcome is the result of writing a single file. sum is the SHA-256 of the written content, empty if
+// the file was not fully written. blocks lists the hashes of the blocks that could not be retrieved and
+// padded the bytes written as zeros in their place. folder marks the outcome of listing a folder contents
+type fileOutcome struct {
+	written int64
+	sum     string
+	blocks  []string
+	padded  int64
+	skipped bool
+	folder  bool
+	err     error
+}
+
+// record appends an entry to the journal. Each entry is written and synced on its own so it survives a
+// crash or a power loss
+func (j *journal) record(mt *MetaTree, o fileOutcome) error {
+	e := journalEntry{
+		Path:    mt.path,
+		ID:      mt.mf.ID,
+		Hash:    mt.mf.Hash,
+		Size:    mt.mf.Size,
+		Written: o.written,
+		SHA256:  o.sum,
+		Blocks:  o.blocks,
+		Padded:  o.padded,
+		Skipped: o.skipped,
+		Folder:  o.folder,
+		Time:    time.Now(),
+	}
+	if o.err != nil {
+		e.Error = o.err.Error()
+	}
+	line, err := json.Marshal(e)
+	if err != nil {
+		return errors.New("recovery.record()", err)
+	}
+	j.lock.Lock()
+	defer j.lock.Unlock()
+	if _, err := j.file.Write(append(line, '\n')); err != nil {
+		return errors.New("recovery.record()", err)
+	}
+	if err := j.file.Sync(); err != nil {
+		return errors.New("recovery.record()", err)
+	}
+	j.entries[e.Path] = e
+	return nil
+}
+
+// snapshot returns the latest entry of every file on the journal
+func (j *journal) snapshot() []journalEntry {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+	out := make([]journalEntry, 0, len(j.entries))
+	for _, e := range j.entries {
+		out = append(out, e)
+	}
+	return out
+}
+
+func (j *journal) close() error {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+	if err := j.file.Sync(); err != nil {
+		j.file.Close()
+		return errors.New("recovery.close()", err)
+	}
+	return j.file.Close()
+}
@@ -0,0 +1,38 @@
+package recovery
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/clonercl/reposerver"
+	"golang.org/x/text/unicode/norm"
+)
+
+func TestCompletedNormalizesPath(t *testing.T) {
+	dir, err := ioutil.TempDir("", "journal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// Files are created under their NFC name, whatever form the metafile name has
+	name := norm.NFD.String("canción.txt")
+	p := filepath.Join(dir, name)
+	if err := ioutil.WriteFile(norm.NFC.String(p), []byte("hello"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	mt := &MetaTree{mf: &reposerver.Metafile{ID: "a", Name: name, Hash: "h", Size: 5}, path: p}
+	j := &journal{entries: map[string]journalEntry{
+		p: {Path: p, ID: "a", Hash: "h", Size: 5, Written: 5},
+	}}
+	if !j.completed(mt) {
+		t.Error("file written under its NFC name not seen as completed")
+	}
+	j.entries[p] = journalEntry{Path: p, ID: "a", Hash: "h", Size: 6, Written: 6}
+	mt.mf.Size = 6
+	if j.completed(mt) {
+		t.Error("file with a different size seen as completed")
+	}
+}
@@ -0,0 +1,132 @@
+package recovery
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/morrocker/errors"
+	"golang.org/x/text/unicode/norm"
+)
+
+// File error statuses. A failed file was not written at all, a degraded one was written with missing
+// content and a skipped one was left out by the missing block policy. An unlisted entry is a folder whose
+// contents could not be retrieved, so none of the files under it were recovered
+const (
+	FileFailed     = "failed"
+	FileDegraded   = "degraded"
+	FileSkipped    = "skipped"
+	FolderUnlisted = "unlisted"
+)
+
+// FileError describes a file that could not be fully recovered. Path is relative to the recovery output
+// and Blocks lists the hashes of the blocks that could not be retrieved
+type FileError struct {
+	Path     string    `json:"path"`
+	Metafile string    `json:"metafile"`
+	Hash     string    `json:"hash"`
+	Size     int64     `json:"size"`
+	Written  int64     `json:"written"`
+	Padded   int64     `json:"padded,omitempty"`
+	Blocks   []string  `json:"blocks"`
+	Status   string    `json:"status"`
+	Reason   string    `json:"reason"`
+	Time     time.Time `json:"time"`
+}
+
+// outputRoot returns the folder the recovery files are written to, the staging one for archives
+func (r *Recovery) outputRoot() string {
+	if r.Archive != nil {
+		return path.Join(r.stagingPath(), r.Data.Disk)
+	}
+	return r.OutputPath()
+}
+
+// Errors returns every file of the recovery that failed or was written with missing content, sorted by
+// path. Files fixed by a later run are left out
+func (r *Recovery) Errors() ([]FileError, error) {
+	op := "recovery.Errors()"
+	f, err := os.Open(r.journalPath())
+	if os.IsNotExist(err) {
+		return []FileError{}, nil
+	} else if err != nil {
+		return nil, errors.New(op, err)
+	}
+	defer f.Close()
+	entries := make(map[string]journalEntry)
+	if err := readJournal(f, entries); err != nil {
+		return nil, errors.Extend(op, err)
+	}
+
+	root := r.outputRoot()
+	out := []FileError{}
+	for _, e := range entries {
+		if e.Error == "" {
+			continue
+		}
+		fe := FileError{
+			Path:     e.Path,
+			Metafile: e.ID,
+			Hash:     e.Hash,
+			Size:     e.Size,
+			Written:  e.Written,
+			Padded:   e.Padded,
+			Blocks:   e.Blocks,
+			Status:   FileFailed,
+			Reason:   e.Error,
+			Time:     e.Time,
+		}
+		if fe.Blocks == nil {
+			fe.Blocks = []string{}
+		}
+		// Only fully written files get their content hash recorded
+		if e.Folder {
+			fe.Status = FolderUnlisted
+		} else if e.SHA256 != "" {
+			fe.Status = FileDegraded
+		} else if e.Skipped {
+			fe.Status = FileSkipped
+		}
+		if rel, err := filepath.Rel(root, e.Path); err == nil && !strings.HasPrefix(rel, "..") {
+			fe.Path = filepath.ToSlash(norm.NFC.String(rel))
+		}
+		out = append(out, fe)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Path < out[j].Path })
+	return out, nil
+}
+
+// WriteErrorsCSV writes a list of file errors as CSV with a header row. Block hashes are space separated
+func WriteErrorsCSV(w io.Writer, errs []FileError) error {
+	op := "recovery.WriteErrorsCSV()"
+	cw := csv.NewWriter(w)
+	if err := cw.Write([]string{"path", "metafile", "status", "size", "written", "blocks", "reason", "time"}); err != nil {
+		return errors.New(op, err)
+	}
+	for _, e := range errs {
+		row := []string{
+			e.Path,
+			e.Metafile,
+			e.Status,
+			fmt.Sprint(e.Size),
+			fmt.Sprint(e.Written),
+			strings.Join(e.Blocks, " "),
+			e.Reason,
+			e.Time.Format(time.RFC3339),
+		}
+		if err := cw.Write(row); err != nil {
+			return errors.New(op, err)
+		}
+	}
+	cw.Flush()
+	if err := cw.Error(); err != nil {
+		return errors.New(op, err)
+	}
+	return nil
+}
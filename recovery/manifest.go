@@ -0,0 +1,275 @@
+package recovery
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/clonercl/reposerver"
+	"github.com/morrocker/errors"
+	"github.com/morrocker/log"
+	"golang.org/x/text/unicode/norm"
+)
+
+// ManifestName is the file written at the root of every recovery output listing what was written
+const ManifestName = "recovery-manifest.json"
+
+// Manifest lists every file a recovery wrote with its size and content hash
+type Manifest struct {
+	Recovery  int             `json:"recovery"`
+	Created   time.Time       `json:"created"`
+	Algorithm string          `json:"algorithm"`
+	Files     []ManifestEntry `json:"files"`
+}
+
+// ManifestEntry describes a single written file. Paths are relative to the manifest folder. Error is set
+// for files written with missing content
+type ManifestEntry struct {
+	Path     string `json:"path"`
+	Size     int64  `json:"size"`
+	SHA256   string `json:"sha256"`
+	Metafile string `json:"metafile"`
+	Error    string `json:"error,omitempty"`
+}
+
+// VerifyReport lists the differences found between a recovery output and its manifest and metafile tree
+type VerifyReport struct {
+	Root         string          `json:"root"`
+	Files        int             `json:"files"`
+	OK           int             `json:"ok"`
+	Missing      []string        `json:"missing"`
+	Extra        []string        `json:"extra"`
+	Corrupted    []VerifyProblem `json:"corrupted"`
+	Degraded     []string        `json:"degraded"`
+	NotRecovered []string        `json:"notRecovered,omitempty"`
+	TreeChecked  bool            `json:"treeChecked"`
+}
+
+// VerifyProblem describes why a file does not match its manifest entry
+type VerifyProblem struct {
+	Path   string `json:"path"`
+	Reason string `json:"reason"`
+}
+
+// Clean returns true if the output matches its manifest and tree exactly
+func (v *VerifyReport) Clean() bool {
+	return len(v.Missing) == 0 && len(v.Extra) == 0 && len(v.Corrupted) == 0 && len(v.Degraded) == 0 && len(v.NotRecovered) == 0
+}
+
+// writeManifest builds the manifest of root from the journal and writes it at root. Files recorded
+// without a hash, from journals older than manifests, are hashed from disk
+func (r *Recovery) writeManifest(root string) (string, error) {
+	op := "recovery.writeManifest()"
+	m := Manifest{Recovery: r.Data.ID, Created: time.Now(), Algorithm: "sha256", Files: []ManifestEntry{}}
+	for _, e := range r.journal.snapshot() {
+		if e.Written == 0 && e.Error != "" {
+			continue
+		}
+		rel, err := filepath.Rel(root, e.Path)
+		if err != nil || strings.HasPrefix(rel, "..") {
+			continue
+		}
+		sum := e.SHA256
+		if sum == "" {
+			if sum, err = hashFile(e.Path); err != nil {
+				r.log.Errorln(errors.Extend(op, err))
+				continue
+			}
+		}
+		m.Files = append(m.Files, ManifestEntry{
+			Path:     filepath.ToSlash(norm.NFC.String(rel)),
+			Size:     e.Written,
+			SHA256:   sum,
+			Metafile: e.ID,
+			Error:    e.Error,
+		})
+	}
+	sort.Slice(m.Files, func(i, j int) bool { return m.Files[i].Path < m.Files[j].Path })
+
+	data, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return "", errors.New(op, err)
+	}
+	filename := path.Join(root, ManifestName)
+	if err := writeSidecar(filename, data); err != nil {
+		return "", errors.New(op, err)
+	}
+	r.log.Notice("Manifest with %d files written to %s", len(m.Files), filename)
+	return filename, nil
+}
+
+// hashFile returns the SHA-256 of a file content
+func hashFile(filename string) (string, error) {
+	f, err := os.Open(norm.NFC.String(filename))
+	if err != nil {
+		return "", errors.New("recovery.hashFile()", err)
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", errors.New("recovery.hashFile()", err)
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// VerifyManifest re-reads every file under root and compares it against the manifest found at root
+func VerifyManifest(root string) (*VerifyReport, error) {
+	v, _, err := verifyManifest(root)
+	if err != nil {
+		return nil, errors.Extend("recovery.VerifyManifest()", err)
+	}
+	return v, nil
+}
+
+func verifyManifest(root string) (*VerifyReport, *Manifest, error) {
+	op := "recovery.verifyManifest()"
+	data, err := ioutil.ReadFile(path.Join(root, ManifestName))
+	if err != nil {
+		return nil, nil, errors.New(op, err)
+	}
+	var m Manifest
+	if err := json.Unmarshal(data, &m); err != nil {
+		return nil, nil, errors.New(op, err)
+	}
+
+	v := &VerifyReport{Root: root, Files: len(m.Files), Missing: []string{}, Extra: []string{}, Corrupted: []VerifyProblem{}, Degraded: []string{}}
+	listed := make(map[string]bool)
+	for _, e := range m.Files {
+		listed[e.Path] = true
+		filename := path.Join(root, filepath.FromSlash(e.Path))
+		fi, err := os.Stat(norm.NFC.String(filename))
+		if os.IsNotExist(err) {
+			v.Missing = append(v.Missing, e.Path)
+			continue
+		} else if err != nil {
+			v.Corrupted = append(v.Corrupted, VerifyProblem{e.Path, err.Error()})
+			continue
+		}
+		if fi.Size() != e.Size {
+			v.Corrupted = append(v.Corrupted, VerifyProblem{e.Path, fmt.Sprintf("size is %d, expected %d", fi.Size(), e.Size)})
+			continue
+		}
+		sum, err := hashFile(filename)
+		if err != nil {
+			v.Corrupted = append(v.Corrupted, VerifyProblem{e.Path, err.Error()})
+			continue
+		}
+		if sum != e.SHA256 {
+			v.Corrupted = append(v.Corrupted, VerifyProblem{e.Path, "content does not match its hash"})
+			continue
+		}
+		if e.Error != "" {
+			v.Degraded = append(v.Degraded, e.Path)
+			continue
+		}
+		v.OK++
+	}
+
+	err = filepath.Walk(root, func(p string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return nil
+		}
+		rel, err := filepath.Rel(root, p)
+		if err != nil {
+			return nil
+		}
+		rel = filepath.ToSlash(norm.NFC.String(rel))
+		if rel != ManifestName && rel != PaddedListName && !listed[rel] {
+			v.Extra = append(v.Extra, rel)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, nil, errors.New(op, err)
+	}
+	return v, &m, nil
+}
+
+// Verify checks a recovery output against its manifest and, if the metafile tree is still cached, lists the
+// tree files that never made it into the output. An empty root verifies the recovery own output. Any other
+// root must be under the directory the recovery was written to, like the folder an archive was extracted to
+func (r *Recovery) Verify(root string) (*VerifyReport, error) {
+	op := "recovery.Verify()"
+	if r.OutputPath() == "" {
+		return nil, errors.New(op, fmt.Sprintf("Recovery #%d has no output set", r.Data.ID))
+	}
+	if root == "" {
+		if r.Archive != nil {
+			return nil, errors.New(op, fmt.Sprintf("Recovery #%d was written as an archive. Give the path where it was extracted", r.Data.ID))
+		}
+		root = r.OutputPath()
+	}
+	if err := r.checkVerifyRoot(root); err != nil {
+		return nil, errors.Extend(op, err)
+	}
+	v, m, err := verifyManifest(root)
+	if err != nil {
+		return nil, errors.Extend(op, err)
+	}
+
+	tree, err := r.readTreeCache(0)
+	if err != nil {
+		log.Alert("Recovery #%d metafile tree is not cached anymore. Files never recovered can't be listed", r.Data.ID)
+		return v, nil
+	}
+	v.TreeChecked = true
+	listed := make(map[string]bool)
+	for _, e := range m.Files {
+		listed[e.Path] = true
+	}
+	start := ""
+	if tree.mf.Type != reposerver.FolderType {
+		start = tree.mf.Name
+	}
+	v.NotRecovered = []string{}
+	walkTreeFiles(tree, start, func(p string) {
+		if !listed[p] {
+			v.NotRecovered = append(v.NotRecovered, p)
+		}
+	})
+	return v, nil
+}
+
+// checkVerifyRoot returns an error unless root is the recovery output or a folder under the directory it was
+// written to. Links are followed first, so they can't lead the walk anywhere else
+func (r *Recovery) checkVerifyRoot(root string) error {
+	op := "recovery.checkVerifyRoot()"
+	if !filepath.IsAbs(root) {
+		return errors.New(op, fmt.Sprintf("Path %s is not absolute", root))
+	}
+	resolved, err := filepath.EvalSymlinks(root)
+	if err != nil {
+		return errors.New(op, err)
+	}
+	if out, err := filepath.EvalSymlinks(r.OutputPath()); err == nil && resolved == out {
+		return nil
+	}
+	base, err := filepath.EvalSymlinks(r.OutputTo)
+	if err != nil {
+		return errors.New(op, err)
+	}
+	if rel, err := filepath.Rel(base, resolved); err != nil || rel == "." || rel == ".." || strings.HasPrefix(rel, "../") {
+		return errors.New(op, fmt.Sprintf("Path %s is not under recovery #%d output directory %s", root, r.Data.ID, r.OutputTo))
+	}
+	return nil
+}
+
+// walkTreeFiles calls f with the slash separated path of every file in mt, relative to the tree root
+func walkTreeFiles(mt *MetaTree, p string, f func(string)) {
+	if mt.mf.Type != reposerver.FolderType {
+		f(norm.NFC.String(p))
+		return
+	}
+	for _, child := range mt.children {
+		walkTreeFiles(child, path.Join(p, child.mf.Name), f)
+	}
+}
@@ -0,0 +1,49 @@
+package recovery
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestCheckVerifyRoot(t *testing.T) {
+	dir, err := ioutil.TempDir("", "verify")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	out := filepath.Join(dir, "out")
+	r := &Recovery{Data: &Data{ID: 1, Org: "org", User: "user", Machine: "machine", Disk: "disk"}, OutputTo: out}
+	extracted := filepath.Join(out, "extracted")
+	other := filepath.Join(dir, "other")
+	for _, p := range []string{r.OutputPath(), extracted, other} {
+		if err := os.MkdirAll(p, 0700); err != nil {
+			t.Fatal(err)
+		}
+	}
+	link := filepath.Join(out, "link")
+	if err := os.Symlink(other, link); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		root string
+		ok   bool
+	}{
+		{r.OutputPath(), true},
+		{extracted, true},
+		{out, false},
+		{other, false},
+		{filepath.Join(out, "..", "other"), false},
+		{link, false},
+		{"/", false},
+		{"out/extracted", false},
+		{filepath.Join(out, "missing"), false},
+	} {
+		if err := r.checkVerifyRoot(tc.root); (err == nil) != tc.ok {
+			t.Errorf("checkVerifyRoot(%q) = %v, want ok %v", tc.root, err, tc.ok)
+		}
+	}
+}
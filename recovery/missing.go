@@ -0,0 +1,118 @@
+package recovery
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/morrocker/errors"
+	"github.com/morrocker/log"
+	"github.com/morrocker/recoveryserver/config"
+	"golang.org/x/text/unicode/norm"
+)
+
+// blockSize is the size of every block of a file but the last one
+const blockSize = 1024 * 1000
+
+// Policies for blocks that can't be retrieved from any store
+const (
+	// MissingBlockFail leaves the file out and counts it as an error
+	MissingBlockFail = "fail"
+	// MissingBlockZero writes zeros in place of the block, keeping the file size, and lists the file as padded
+	MissingBlockZero = "zero"
+	// MissingBlockSkip leaves the file out without counting it as an error
+	MissingBlockSkip = "skip"
+)
+
+// PaddedListName is the file written next to the manifest listing every file with zero filled blocks
+const PaddedListName = "recovery-padded-files.txt"
+
+func validMissingBlockPolicy(p string) bool {
+	return p == MissingBlockFail || p == MissingBlockZero || p == MissingBlockSkip
+}
+
+// CheckMissingBlockPolicy returns an error if the configured MissingBlockPolicy is not a known policy
+func CheckMissingBlockPolicy() error {
+	if p := config.Data.MissingBlockPolicy; p != "" && !validMissingBlockPolicy(p) {
+		return errors.New("recovery.CheckMissingBlockPolicy()", fmt.Sprintf("Unknown missing block policy %q. Use fail, zero or skip", p))
+	}
+	return nil
+}
+
+// missingBlockPolicy returns the recovery policy, falling back to the server one and then to zero filling
+func (r *Recovery) missingBlockPolicy() string {
+	r.policyLock.Lock()
+	policy := r.MissingBlocks
+	r.policyLock.Unlock()
+	if validMissingBlockPolicy(policy) {
+		return policy
+	}
+	if validMissingBlockPolicy(config.Data.MissingBlockPolicy) {
+		return config.Data.MissingBlockPolicy
+	}
+	return MissingBlockZero
+}
+
+// SetMissingBlocks sets what the recovery does with files that have unavailable blocks. An empty policy
+// uses the server default. It can't change while the recovery has an execution, even a paused one
+func (r *Recovery) SetMissingBlocks(policy string) error {
+	op := "recovery.SetMissingBlocks()"
+	if policy != "" && !validMissingBlockPolicy(policy) {
+		return errors.New(op, fmt.Sprintf("Unknown missing block policy %q. Use fail, zero or skip", policy))
+	}
+	if err := r.CanRemove(); err != nil {
+		return errors.Extend(op, err)
+	}
+	r.policyLock.Lock()
+	r.MissingBlocks = policy
+	r.policyLock.Unlock()
+	log.InfoV("Recovery #%d missing block policy set to %s", r.Data.ID, r.missingBlockPolicy())
+	r.notify()
+	return nil
+}
+
+// expectedBlockSize returns the length block i of a file of the given size should have
+func expectedBlockSize(size int64, i int) int64 {
+	left := size - int64(i)*blockSize
+	if left < 0 {
+		return 0
+	}
+	if left > blockSize {
+		return blockSize
+	}
+	return left
+}
+
+// writePaddedList lists at root every file written with zero filled blocks. Returns an empty filename,
+// and removes any previous list, when there are none
+func (r *Recovery) writePaddedList(root string) (string, error) {
+	op := "recovery.writePaddedList()"
+	filename := path.Join(root, PaddedListName)
+	var lines []string
+	for _, e := range r.journal.snapshot() {
+		if e.Padded == 0 || e.Error == "" || e.SHA256 == "" {
+			continue
+		}
+		rel, err := filepath.Rel(root, e.Path)
+		if err != nil || strings.HasPrefix(rel, "..") {
+			continue
+		}
+		lines = append(lines, fmt.Sprintf("%s\t%d\t%d\t%s", filepath.ToSlash(norm.NFC.String(rel)), e.Padded, e.Size, strings.Join(e.Blocks, " ")))
+	}
+	if len(lines) == 0 {
+		if err := os.Remove(filename); err != nil && !os.IsNotExist(err) {
+			return "", errors.New(op, err)
+		}
+		return "", nil
+	}
+	sort.Strings(lines)
+	header := "# Files with unavailable blocks written as zeros. Their content is NOT complete\n# path\tzero filled bytes\tsize\tmissing blocks\n"
+	if err := writeSidecar(filename, []byte(header+strings.Join(lines, "\n")+"\n")); err != nil {
+		return "", errors.New(op, err)
+	}
+	r.log.Alert("%d files were written with zero filled blocks. Listed on %s", len(lines), filename)
+	return filename, nil
+}
@@ -0,0 +1,50 @@
+package recovery
+
+import (
+	"testing"
+
+	"github.com/morrocker/broadcast"
+)
+
+func TestExpectedBlockSize(t *testing.T) {
+	for _, tc := range []struct {
+		size int64
+		i    int
+		want int64
+	}{
+		{0, 0, 0},
+		{1, 0, 1},
+		{blockSize - 1, 0, blockSize - 1},
+		{blockSize, 0, blockSize},
+		{blockSize + 1, 0, blockSize},
+		{blockSize + 1, 1, 1},
+		{3*blockSize + 10, 2, blockSize},
+		{3*blockSize + 10, 3, 10},
+		{2 * blockSize, 2, 0},
+		{10, 5, 0},
+	} {
+		if got := expectedBlockSize(tc.size, tc.i); got != tc.want {
+			t.Errorf("expectedBlockSize(%d, %d) = %d, want %d", tc.size, tc.i, got, tc.want)
+		}
+	}
+}
+
+func TestSetMissingBlocksNeedsNoExecution(t *testing.T) {
+	r := &Recovery{Data: &Data{ID: 1}, broadcaster: broadcast.New()}
+	for _, s := range []State{Running, Paused} {
+		r.Status = s
+		if err := r.SetMissingBlocks(MissingBlockFail); err == nil {
+			t.Errorf("policy changed while %v", s)
+		}
+	}
+	r.Status = Queued
+	if err := r.SetMissingBlocks(MissingBlockSkip); err != nil {
+		t.Fatalf("SetMissingBlocks() on a queued recovery failed: %v", err)
+	}
+	if p := r.missingBlockPolicy(); p != MissingBlockSkip {
+		t.Errorf("missingBlockPolicy() = %q, want %q", p, MissingBlockSkip)
+	}
+	if err := r.SetMissingBlocks("pad"); err == nil {
+		t.Error("unknown policy accepted")
+	}
+}
@@ -0,0 +1,56 @@
+package recovery
+
+import (
+	"fmt"
+
+	"github.com/morrocker/errors"
+	"github.com/morrocker/recoveryserver/secrets"
+)
+
+func passphraseName(id int) string {
+	return fmt.Sprintf("recovery-%d", id)
+}
+
+func (r *Recovery) passphraseName() string {
+	return passphraseName(r.Data.ID)
+}
+
+// Passphrase returns the passphrase of a recovery encrypted output. Passphrases outlive their recovery,
+// so it is found even after the recovery was archived or removed
+func Passphrase(id int) (string, error) {
+	op := "recovery.Passphrase()"
+	if secrets.Shared == nil {
+		return "", errors.New(op, "No secrets store is configured")
+	}
+	p, ok, err := secrets.Shared.Get(passphraseName(id))
+	if err != nil {
+		return "", errors.Extend(op, err)
+	}
+	if !ok {
+		return "", errors.New(op, fmt.Sprintf("Recovery #%d has no passphrase", id))
+	}
+	return p, nil
+}
+
+// ensurePassphrase returns the recovery passphrase, generating and storing a new one if it has none.
+// Passphrases only live in the secrets store, never in the recovery logs, output or delivery PDF
+func (r *Recovery) ensurePassphrase() (string, error) {
+	op := "recovery.ensurePassphrase()"
+	if secrets.Shared == nil {
+		return "", errors.New(op, "Encrypted output needs SecretsKey to be configured")
+	}
+	p, ok, err := secrets.Shared.Get(r.passphraseName())
+	if err != nil {
+		return "", errors.Extend(op, err)
+	}
+	if ok {
+		return p, nil
+	}
+	if p, err = secrets.NewPassphrase(); err != nil {
+		return "", errors.Extend(op, err)
+	}
+	if err := secrets.Shared.Set(r.passphraseName(), p); err != nil {
+		return "", errors.Extend(op, err)
+	}
+	return p, nil
+}
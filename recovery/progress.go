@@ -0,0 +1,93 @@
+package recovery
+
+import "time"
+
+// Progress is a snapshot of a recovery state and tracker values
+type Progress struct {
+	ID     int              `json:"id"`
+	State  string           `json:"state"`
+	Step   string           `json:"step"`
+	Gauges map[string]Gauge `json:"gauges,omitempty"`
+	Rate   string           `json:"rate,omitempty"`
+	ETA    string           `json:"eta,omitempty"`
+}
+
+// Gauge stores the current and total values of a single tracker gauge
+type Gauge struct {
+	Current int64 `json:"current"`
+	Total   int64 `json:"total"`
+}
+
+// trackedGauges lists the tracker gauges reported on a Progress snapshot
+var trackedGauges = []string{"files", "blocks", "size", "completedSize", "errors", "metafiles", "cache"}
+
+// Progress returns the current state, step and tracker values of the recovery. Gauges are only
+// present once the recovery has been run or precalculated
+func (r *Recovery) Progress() Progress {
+	p := Progress{
+		ID:    r.Data.ID,
+		State: r.Status.String(),
+		Step:  r.Step.String(),
+	}
+	if r.tracker == nil {
+		return p
+	}
+	p.Gauges = make(map[string]Gauge)
+	for _, name := range trackedGauges {
+		c, t, err := r.tracker.RawValues(name)
+		if err != nil {
+			continue
+		}
+		p.Gauges[name] = Gauge{Current: c, Total: t}
+	}
+	if rate, err := r.tracker.ProgressRate("size"); err == nil {
+		p.Rate = rate + "ps"
+	}
+	if eta, err := r.tracker.ETA("completedSize"); err == nil {
+		p.ETA = eta
+	}
+	return p
+}
+
+// Detail describes a single recovery with its settings and full progress
+type Detail struct {
+	Progress
+	Priority     string           `json:"priority"`
+	PriorityCode int              `json:"priorityCode"`
+	Destination  string           `json:"destination"`
+	Archive      *ArchiveSettings `json:"archive,omitempty"`
+	LastRetry    *RetryResult     `json:"lastRetry,omitempty"`
+	MissingBlock string           `json:"missingBlocks"`
+	Cloud        string           `json:"cloud"`
+	Bandwidth    int64            `json:"bandwidthLimit"`
+	Data         *Data            `json:"data"`
+	Errors       int64            `json:"errors"`
+	Elapsed      string           `json:"elapsed,omitempty"`
+}
+
+// Detail returns the recovery settings along with its progress, error count and elapsed time
+func (r *Recovery) Detail() Detail {
+	d := Detail{
+		Progress:     r.Progress(),
+		Priority:     r.Priority.String(),
+		PriorityCode: int(r.Priority),
+		Destination:  r.OutputTo,
+		Archive:      r.Archive,
+		LastRetry:    r.LastRetry,
+		MissingBlock: r.missingBlockPolicy(),
+		Cloud:        r.CloudName,
+		Bandwidth:    r.BandwidthLimit,
+		Data:         r.Data,
+	}
+	if g, ok := d.Gauges["errors"]; ok {
+		d.Errors = g.Current
+	}
+	if !r.startedAt.IsZero() {
+		end := time.Now()
+		if !r.finishedAt.IsZero() {
+			end = r.finishedAt
+		}
+		d.Elapsed = end.Sub(r.startedAt).Truncate(time.Second).String()
+	}
+	return d
+}
@@ -7,13 +7,21 @@ import (
 	"github.com/morrocker/log"
 )
 
-// Run starts a recovery execution
+// Run starts the execution of a recovery set as Running by Claim
 func (r *Recovery) Run() {
 	op := "recovery.Run()"
-	if err := r.Start(); err != nil {
-		log.Errorln(errors.Extend(op, err))
-		return
+	defer r.execution.Done()
+	defer r.endSuspend()
+	if r.Retry {
+		// A canceled retry only replaces files it fully wrote again, so the recovery is Done again
+		defer func() {
+			if r.Status == Canceled {
+				r.Retry = false
+				r.changeState(Done)
+			}
+		}()
 	}
+	r.notify()
 	log.Info("Starting recovery %d", r.Data.ID)
 	r.initLogger()
 	r.startTracker()
@@ -22,23 +30,27 @@ func (r *Recovery) Run() {
 
 	// CHECK THIS POINT OR THE END. IT IS IMPORTANT TO CONSIDER DATA DUPLICATION IF RECOVEEY IS STOPPED > STARTED
 
+	// Metafiles and Files steps overlap. Files start downloading as soon as they are found and the
+	// step changes to Files once the whole tree is known
 	r.changeStep(Metafiles)
 	if r.flowGate() {
 		return
 	}
 	start := time.Now()
-	tree, err := r.GetRecoveryTree()
-	if err != nil {
-		log.Errorln(errors.Extend(op, err))
-		r.Cancel()
-		return
-	}
-	r.changeStep(Files)
-	if r.flowGate() {
-		return
-	}
-
-	if err := r.getFiles(tree); err != nil {
+	if r.Retry {
+		// A failed retry leaves the recovery Done as it was, with its failed files still listed
+		err := r.retryFiles()
+		if r.suspended() {
+			// Still a retry when it resumes
+			return
+		}
+		r.Retry = false
+		if err != nil {
+			log.Errorln(errors.Extend(op, err))
+			r.changeState(Done)
+			return
+		}
+	} else if err := r.getFiles(); err != nil {
 		log.Errorln(errors.Extend(op, err))
 		r.Cancel()
 		return
@@ -74,12 +86,13 @@ func (r *Recovery) PreCalculate() {
 	if r.flowGate() {
 		return
 	}
-	_, err := r.GetRecoveryTree()
+	tree, err := r.GetRecoveryTree("", nil)
 	if err != nil {
 		log.Errorln(errors.Extend(op, err))
 		r.Cancel()
 		return
 	}
+	r.cacheTree(tree)
 	if r.flowGate() {
 		log.Infoln("Precalculations cancelled")
 		return
@@ -3,20 +3,39 @@ package recovery
 import (
 	"encoding/json"
 	"fmt"
+	"net"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
 
 	"github.com/clonercl/blockserver/blocks"
 	blocksremote "github.com/clonercl/blockserver/blocks/master/remote"
 	legacy "github.com/clonercl/kaon/blocks"
 	legacyremote "github.com/clonercl/kaon/blocks/master/remote"
 	"github.com/morrocker/errors"
+	"github.com/morrocker/log"
+	"github.com/morrocker/recoveryserver/blockcache"
 	"github.com/morrocker/recoveryserver/config"
+	"github.com/morrocker/recoveryserver/metrics"
+	"github.com/morrocker/recoveryserver/throttle"
 )
 
 // RBS stores the info to set-up and query remote Files and Blocksmaster
 type RBS struct {
 	LegacyStores  []legacy.MasterStore
 	CurrentStores []blocks.MasterStore
+	Addresses     []string
+	Cloud         string
 	Legacy        bool
+	BlockHash     string
+	mismatch      func(hash, address string)
+	limiters      []*throttle.Limiter
+	health        []*storeHealth
+	hedge         hedgeSettings
+	cache         *blockcache.Cache
+	cacheLookup   func(hit bool)
 }
 
 // BlocksList asfdasfd asdf a
@@ -25,9 +44,17 @@ type BlocksList struct {
 }
 
 // NewRBS Returns a new cloud object
-func NewRBS(c config.Cloud) *RBS {
+func NewRBS(name string, c config.Cloud) *RBS {
 	newRemote := &RBS{}
+	newRemote.Cloud = name
 	newRemote.Legacy = c.Legacy
+	newRemote.BlockHash = c.BlockHash
+	for _, bm := range c.Stores {
+		newRemote.Addresses = append(newRemote.Addresses, bm.Address)
+		newRemote.health = append(newRemote.health, getStoreHealth(name, bm.Address))
+	}
+	newRemote.hedge = newHedgeSettings(name, c)
+	newRemote.cache = blockcache.Shared
 	if newRemote.Legacy {
 		for _, bm := range c.Stores {
 			newRemote.LegacyStores = append(newRemote.LegacyStores, legacyremote.New(bm.Address, bm.Magic))
@@ -55,27 +82,192 @@ func (c *RBS) GetBlocksList(hash, user string) (*BlocksList, error) {
 	return ret, nil
 }
 
-// GetBlocks
+// OnMismatch sets a function to be called every time a store returns a block that fails verification
+func (c *RBS) OnMismatch(f func(hash, address string)) {
+	c.mismatch = f
+}
+
+// OnCacheLookup sets a function to be called every time the block cache is looked up
+func (c *RBS) OnCacheLookup(f func(hit bool)) {
+	c.cacheLookup = f
+}
+
+// Throttle sets the limiters every downloaded block is accounted on
+func (c *RBS) Throttle(l ...*throttle.Limiter) {
+	c.limiters = l
+}
+
+// retryDelay is the pause before going over the stores a second time
+const retryDelay = 500 * time.Millisecond
+
+// GetBlock retrieves a block from the healthiest store that returns content matching its hash. Stores
+// with an open circuit are skipped unless every store of the cloud is open. With hedging enabled a slow
+// request is raced against the next healthy store
 func (c *RBS) GetBlock(hash, user string) ([]byte, error) {
 	op := "remotes.GetBlock()"
 
+	if !checkableHash(c.BlockHash, hash) {
+		return nil, errors.New(op, fmt.Sprintf("block %q has a hash of unknown type and can't be verified. Set the cloud BlockHash", hash))
+	}
+	if content, ok := c.cached(hash); ok {
+		return content, nil
+	}
+
+	var mismatched bool
 	for retries := 0; retries < 2; retries++ {
-		if c.Legacy {
-			for _, bs := range c.LegacyStores {
-				content, err := bs.Retrieve(hash)
-				if err == nil {
-					return content, nil
-				}
+		if retries > 0 {
+			metrics.BlockRetries.WithLabelValues(c.Cloud).Inc()
+			time.Sleep(retryDelay)
+		}
+		order, allOpen := c.storesOrder()
+		tried := make(map[int]bool)
+		for k, i := range order {
+			if tried[i] {
+				continue
 			}
-		} else {
-			for _, bs := range c.CurrentStores {
-				content, err := bs.Retrieve(hash, user)
-				if err == nil {
-					return content, nil
+			if !c.health[i].allow() && !allOpen {
+				continue
+			}
+			tried[i] = true
+			hedge := -1
+			if c.hedge.enabled {
+				hedge = c.hedgeCandidate(order[k+1:], tried)
+			}
+			if hedge >= 0 {
+				tried[hedge] = true
+			}
+			r := c.hedgedFetch(i, hedge, hash, user)
+			mismatched = mismatched || r.mismatched
+			if r.err != nil {
+				continue
+			}
+			if c.cache != nil {
+				if err := c.cache.Put(hash, r.content); err != nil {
+					log.Errorln(errors.Extend(op, err))
 				}
 			}
+			throttle.Wait(len(r.content), c.limiters...)
+			return r.content, nil
 		}
 	}
 
+	if mismatched {
+		return nil, errors.New(op, fmt.Sprintf("block %q failed verification on every store", hash))
+	}
 	return nil, errors.New(op, fmt.Sprintf("block %q is ungettable", hash))
 }
+
+// cached returns a block from the local block cache if it is there and still matches its hash
+func (c *RBS) cached(hash string) ([]byte, bool) {
+	if c.cache == nil {
+		return nil, false
+	}
+	content, ok := c.cache.Get(hash)
+	if ok && !verifyBlock(c.BlockHash, hash, content) {
+		c.cache.Remove(hash)
+		ok = false
+	}
+	if ok {
+		metrics.BlockCacheLookups.WithLabelValues("hit").Inc()
+	} else {
+		metrics.BlockCacheLookups.WithLabelValues("miss").Inc()
+	}
+	if c.cacheLookup != nil {
+		c.cacheLookup(ok)
+	}
+	return content, ok
+}
+
+// fetchResult is the outcome of a single block request to a store
+type fetchResult struct {
+	content    []byte
+	mismatched bool
+	hedged     bool
+	err        error
+}
+
+// fetch requests a block to a single store and verifies it, recording the store health and metrics
+func (c *RBS) fetch(i int, hash, user string) fetchResult {
+	op := "remotes.fetch()"
+	address := c.Addresses[i]
+	start := time.Now()
+	content, err := c.retrieve(i, hash, user)
+	if err != nil && missingBlock(err) {
+		// The store answered, it just doesn't have the block. That says nothing about its health
+		c.health[i].answered()
+		metrics.BlockErrors.WithLabelValues(c.Cloud, address, "missing").Inc()
+		return fetchResult{err: errors.Extend(op, err)}
+	}
+	if err != nil {
+		c.health[i].failure(err.Error())
+		metrics.BlockErrors.WithLabelValues(c.Cloud, address, "unavailable").Inc()
+		return fetchResult{err: errors.Extend(op, err)}
+	}
+	if !verifyBlock(c.BlockHash, hash, content) {
+		c.health[i].failure("block " + hash + " failed verification")
+		metrics.BlockErrors.WithLabelValues(c.Cloud, address, "mismatch").Inc()
+		if c.mismatch != nil {
+			c.mismatch(hash, address)
+		}
+		return fetchResult{mismatched: true, err: errors.New(op, fmt.Sprintf("block %q failed verification on %s", hash, address))}
+	}
+	c.health[i].success(time.Since(start))
+	metrics.BlocksDownloaded.WithLabelValues(c.Cloud, address).Inc()
+	metrics.BytesDownloaded.WithLabelValues(c.Cloud, address).Add(float64(len(content)))
+	return fetchResult{content: content}
+}
+
+// storesOrder returns the stores indexes sorted from healthiest to least healthy, with the open ones
+// last. allOpen is true when every store circuit is open
+func (c *RBS) storesOrder() (order []int, allOpen bool) {
+	open := make([]bool, len(c.health))
+	scores := make([]float64, len(c.health))
+	allOpen = len(c.health) > 0
+	for i, h := range c.health {
+		order = append(order, i)
+		open[i] = h.isOpen()
+		scores[i] = h.score()
+		allOpen = allOpen && open[i]
+	}
+	sort.SliceStable(order, func(a, b int) bool {
+		i, j := order[a], order[b]
+		if open[i] != open[j] {
+			return !open[i]
+		}
+		return scores[i] < scores[j]
+	})
+	return order, allOpen
+}
+
+// notFoundStatus matches an HTTP 404 answer on an error message, as "404 Not Found" or "status 404", and not
+// a 404 that is part of an address or a hash
+var notFoundStatus = regexp.MustCompile(`\b404 not found\b|\bstatus(?: code)?:? ?404\b`)
+
+// missingBlock returns true if a store error says the block doesn't exist on it, as opposed to a transport
+// or server failure. Network errors never are. The store clients don't export typed errors for a missing
+// block, so their messages are matched
+func missingBlock(err error) bool {
+	if os.IsNotExist(err) {
+		return true
+	}
+	if _, ok := err.(net.Error); ok {
+		return false
+	}
+	msg := strings.ToLower(err.Error())
+	if notFoundStatus.MatchString(msg) {
+		return true
+	}
+	for _, s := range []string{"not found", "no such file", "does not exist", "doesn't exist"} {
+		if strings.Contains(msg, s) {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *RBS) retrieve(i int, hash, user string) ([]byte, error) {
+	if c.Legacy {
+		return c.LegacyStores[i].Retrieve(hash)
+	}
+	return c.CurrentStores[i].Retrieve(hash, user)
+}
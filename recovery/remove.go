@@ -0,0 +1,108 @@
+package recovery
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+
+	"github.com/morrocker/errors"
+	"github.com/morrocker/log"
+	"github.com/morrocker/recoveryserver/config"
+)
+
+// CanRemove returns an error if the recovery still has an execution that could write to its output
+func (r *Recovery) CanRemove() error {
+	op := "recovery.CanRemove()"
+	switch r.Status {
+	case Running:
+		return errors.New(op, fmt.Sprintf("Recovery #%d is Running. Cancel it first", r.Data.ID))
+	case Suspending:
+		return errors.New(op, fmt.Sprintf("Recovery #%d is being suspended for a server shutdown", r.Data.ID))
+	case Paused:
+		if !r.orphaned {
+			return errors.New(op, fmt.Sprintf("Recovery #%d is Paused. Cancel it first", r.Data.ID))
+		}
+	}
+	return nil
+}
+
+// IsFinished returns true if the recovery is Done or Canceled
+func (r *Recovery) IsFinished() bool {
+	return r.Status == Done || r.Status == Canceled
+}
+
+// OutputPath returns the directory where the recovery writes its files, or its archive file when it
+// is written as an archive. Empty if no output is set
+func (r *Recovery) OutputPath() string {
+	return outputPath(r.OutputTo, r.Data, r.Archive)
+}
+
+// OutputPath returns the output of an archived recovery, as Recovery.OutputPath does
+func (d Detail) OutputPath() string {
+	return outputPath(d.Destination, d.Data, d.Archive)
+}
+
+func outputPath(outputTo string, d *Data, a *ArchiveSettings) string {
+	if outputTo == "" || d == nil {
+		return ""
+	}
+	out := path.Join(outputTo, d.Org, d.User, d.Machine, d.Disk)
+	if a != nil {
+		out += "." + a.Format
+	}
+	return out
+}
+
+// removeArchive deletes the recovery archive and all its volumes
+func (r *Recovery) removeArchive() error {
+	op := "recovery.removeArchive()"
+	out := r.OutputPath()
+	volumes, err := filepath.Glob(out + ".[0-9][0-9][0-9]")
+	if err != nil {
+		return errors.New(op, err)
+	}
+	for _, f := range append(volumes, out, out+".manifest.json", out+".padded-files.txt") {
+		if err := os.Remove(f); err != nil && !os.IsNotExist(err) {
+			return errors.New(op, err)
+		}
+	}
+	return nil
+}
+
+// Purge deletes the recovered output, the recovery logs and its journal. The output path is shared by
+// every recovery of the same disk, so callers must check no other recovery uses it before purging
+func (r *Recovery) Purge() error {
+	op := "recovery.Purge()"
+	if err := r.CanRemove(); err != nil {
+		return errors.Extend(op, err)
+	}
+	if out := r.OutputPath(); out != "" {
+		log.Task("Deleting recovery #%d output %s", r.Data.ID, out)
+		if r.Archive != nil {
+			if err := r.removeArchive(); err != nil {
+				return errors.Extend(op, err)
+			}
+			if err := os.RemoveAll(r.stagingPath()); err != nil {
+				return errors.New(op, err)
+			}
+		} else if err := os.RemoveAll(out); err != nil {
+			return errors.New(op, err)
+		}
+	}
+	logs, err := filepath.Glob(path.Join(config.Data.RcvrLogDir, r.Data.Org, r.logPrefix()+".*.log"))
+	if err != nil {
+		return errors.New(op, err)
+	}
+	for _, l := range logs {
+		log.TaskV("Deleting recovery #%d log %s", r.Data.ID, l)
+		if err := os.Remove(l); err != nil {
+			return errors.New(op, err)
+		}
+	}
+	if err := os.Remove(r.journalPath()); err != nil && !os.IsNotExist(err) {
+		return errors.New(op, err)
+	}
+	// The passphrase is kept, as copies of an encrypted output may still be around
+	return nil
+}
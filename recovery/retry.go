@@ -0,0 +1,215 @@
+package recovery
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/clonercl/reposerver"
+	"github.com/morrocker/errors"
+	"github.com/morrocker/log"
+	"github.com/morrocker/recoveryserver/config"
+	"golang.org/x/text/unicode/norm"
+)
+
+// RetryResult summarizes the last retry of the failed files of a recovery
+type RetryResult struct {
+	Started time.Time `json:"started"`
+	Retried int       `json:"retried"`
+	Fixed   int       `json:"fixed"`
+	Failing int       `json:"failing"`
+}
+
+// RetryFailures queues a Done recovery to download again only the files that failed or were written with
+// missing content. Everything else on the output is left untouched
+func (r *Recovery) RetryFailures() error {
+	op := "recovery.RetryFailures()"
+	if r.Status != Done {
+		return errors.New(op, fmt.Sprintf("Recovery #%d must be Done to retry its failed files", r.Data.ID))
+	}
+	if r.Archive != nil {
+		return errors.New(op, fmt.Sprintf("Recovery #%d was written as an archive, which can't be updated. Queue it again as a whole", r.Data.ID))
+	}
+	errs, err := r.Errors()
+	if err != nil {
+		return errors.Extend(op, err)
+	}
+	if len(errs) == 0 {
+		return errors.New(op, fmt.Sprintf("Recovery #%d has no failed files", r.Data.ID))
+	}
+	log.Task("Queueing recovery #%d to retry %d failed files", r.Data.ID, len(errs))
+	r.Retry = true
+	r.changeState(Queued)
+	return nil
+}
+
+// retryFiles downloads again every file the journal shows as failed. The tracker starts with the whole
+// recovery totals, so its values keep describing the full delivery
+func (r *Recovery) retryFiles() error {
+	op := "recovery.retryFiles()"
+	j, err := openJournal(r.journalPath())
+	if err != nil {
+		return errors.Extend(op, err)
+	}
+	r.journal = j
+	defer func() {
+		if err := r.journal.close(); err != nil {
+			r.log.Errorln(errors.Extend(op, err))
+		}
+	}()
+
+	// The cached tree, if still around, gives back the full metafiles with their times
+	metafiles := make(map[string]*reposerver.Metafile)
+	tree, err := r.readTreeCache(0)
+	if err == nil {
+		indexMetafiles(tree, metafiles)
+	} else {
+		tree = nil
+	}
+
+	var failed, folders []*MetaTree
+	for _, e := range j.snapshot() {
+		if e.Folder {
+			if e.Error != "" {
+				mf := &reposerver.Metafile{ID: e.ID, Name: path.Base(e.Path), Type: reposerver.FolderType, Hash: e.Hash}
+				folders = append(folders, &MetaTree{mf: mf, path: e.Path, rel: r.relPath(e.Path)})
+			}
+			continue
+		}
+		r.updateTrackerTotals(e.Size)
+		if e.Error == "" {
+			r.updateTrackerCurrent(e.Size)
+			continue
+		}
+		mf, ok := metafiles[e.ID]
+		if !ok {
+			mf = &reposerver.Metafile{ID: e.ID, Name: path.Base(e.Path), Type: reposerver.FileType, Size: e.Size, Hash: e.Hash}
+		}
+		failed = append(failed, &MetaTree{mf: mf, path: e.Path})
+	}
+	result := &RetryResult{Started: time.Now(), Retried: len(failed) + len(folders)}
+	r.log.Task("Retrying %d failed files and %d unlisted folders", len(failed), len(folders))
+	r.changeStep(Files)
+
+	fc := make(chan *MetaTree, config.Data.FileWorkers)
+	bc := make(chan bData)
+	wg := sync.WaitGroup{}
+	wg2 := sync.WaitGroup{}
+	for i := 0; i < config.Data.FileWorkers; i++ {
+		wg.Add(1)
+		go r.fileWorker(fc, &wg, bc, nil)
+	}
+	for i := 0; i < config.Data.BlockWorkers; i++ {
+		wg2.Add(1)
+		go r.blockWorker(bc, &wg2)
+	}
+	for _, mt := range failed {
+		if err := os.MkdirAll(norm.NFC.String(path.Dir(mt.path)), outputDirMode()); err != nil {
+			r.increaseErrors()
+			r.log.Errorln(errors.New(op, fmt.Sprintf("could not create path '%s': %v", path.Dir(mt.path), err)))
+			continue
+		}
+		fc <- mt
+	}
+	for _, mt := range folders {
+		if r.flowGate() {
+			break
+		}
+		if err := r.retryFolder(mt, fc); err != nil {
+			r.increaseErrors()
+			err = errors.Extend(op, err)
+			r.log.Errorln(err)
+			r.recordFile(mt, fileOutcome{folder: true, err: err})
+			continue
+		}
+		r.recordFile(mt, fileOutcome{folder: true})
+	}
+	close(fc)
+	wg.Wait()
+	r.senders.Wait()
+	close(bc)
+	wg2.Wait()
+	if r.stopped() {
+		return nil
+	}
+	// Writing files again changed their folders times
+	if tree != nil {
+		root, rel := r.OutputPath(), ""
+		if tree.mf.Type != reposerver.FolderType {
+			root, rel = path.Join(root, tree.mf.Name), tree.mf.Name
+		}
+		setTreePaths(tree, root, rel)
+		r.restoreDirAttrs(tree)
+	}
+
+	for _, e := range j.snapshot() {
+		if e.Error != "" {
+			result.Failing++
+		}
+	}
+	result.Fixed = result.Retried - result.Failing
+	if result.Fixed < 0 {
+		result.Fixed = 0
+	}
+	r.LastRetry = result
+	r.finishManifest(r.OutputPath(), nil)
+	r.log.Notice("Retry completed. %d of %d files fixed, %d still failing", result.Fixed, result.Retried, result.Failing)
+	return nil
+}
+
+// retryFolder lists again a folder whose contents could not be retrieved and sends every file under it
+// through fc, applying the recovery filters
+func (r *Recovery) retryFolder(mt *MetaTree, fc chan *MetaTree) error {
+	op := "recovery.retryFolder()"
+	if err := os.MkdirAll(norm.NFC.String(mt.path), outputDirMode()); err != nil {
+		return errors.New(op, fmt.Sprintf("could not create path '%s': %v", mt.path, err))
+	}
+	children, err := r.getChildren(mt.mf.ID)
+	if err != nil {
+		return errors.Extend(op, err)
+	}
+	for _, child := range children {
+		if r.flowGate() {
+			return nil
+		}
+		childTree := newMetaTree(child)
+		childTree.path = path.Join(mt.path, child.Name)
+		childTree.rel = path.Join(mt.rel, child.Name)
+		if r.skipChild(childTree) {
+			continue
+		}
+		if child.Type == reposerver.FolderType {
+			if err := r.retryFolder(childTree, fc); err != nil {
+				return errors.Extend(op, err)
+			}
+			continue
+		}
+		r.updateTrackerTotals(child.Size)
+		fc <- childTree
+	}
+	return nil
+}
+
+// relPath returns p relative to the recovery output root, slash separated
+func (r *Recovery) relPath(p string) string {
+	rel, err := filepath.Rel(r.outputRoot(), p)
+	if err != nil || strings.HasPrefix(rel, "..") {
+		return ""
+	}
+	return filepath.ToSlash(rel)
+}
+
+// indexMetafiles maps every file metafile of a tree by its ID
+func indexMetafiles(mt *MetaTree, index map[string]*reposerver.Metafile) {
+	if mt.mf.Type != reposerver.FolderType {
+		index[mt.mf.ID] = mt.mf
+		return
+	}
+	for _, child := range mt.children {
+		indexMetafiles(child, index)
+	}
+}
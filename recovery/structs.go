@@ -1,10 +1,14 @@
 package recovery
 
 import (
+	"sync"
+	"time"
+
 	"github.com/morrocker/broadcast"
 	"github.com/morrocker/log"
 	tracker "github.com/morrocker/progress-tracker"
 	"github.com/morrocker/recoveryserver/config"
+	"github.com/morrocker/recoveryserver/throttle"
 )
 
 // Recovery stores a single recovery data
@@ -12,15 +16,36 @@ type Recovery struct {
 	Data        *Data    `json:"data"`
 	LoginServer string   `json:"login"`
 	Status      State    `json:"status"`
-	Priority    Priority `json:"-"`
+	Priority    Priority `json:"priority"`
+	// BandwidthLimit caps this recovery block downloads in bytes per second. Zero means unlimited
+	BandwidthLimit int64 `json:"bandwidthLimit"`
+	// MissingBlocks is the policy for blocks no store can return: fail, zero or skip. Empty uses the server one
+	MissingBlocks string `json:"missingBlocks,omitempty"`
 
-	OutputTo    string                 `json:"outputTo"`
-	Step        Step                   `json:"step"`
-	cloud       config.Cloud           `json:"-"`
-	RBS         *RBS                   `json:"-"`
-	broadcaster *broadcast.Broadcaster `json:"-"`
-	tracker     *tracker.SuperTracker  `json:"-"`
-	log         *log.Logger            `json:"-"`
+	OutputTo     string                 `json:"outputTo"`
+	Archive      *ArchiveSettings       `json:"archive,omitempty"`
+	Retry        bool                   `json:"retry,omitempty"`
+	LastRetry    *RetryResult           `json:"lastRetry,omitempty"`
+	Step         Step                   `json:"step"`
+	CloudName    string                 `json:"cloud"`
+	orphaned     bool                   `json:"-"`
+	cloud        config.Cloud           `json:"-"`
+	RBS          *RBS                   `json:"-"`
+	limiter      *throttle.Limiter      `json:"-"`
+	broadcaster  *broadcast.Broadcaster `json:"-"`
+	tracker      *tracker.SuperTracker  `json:"-"`
+	journal      *journal               `json:"-"`
+	senders      sync.WaitGroup         `json:"-"`
+	policyLock   sync.Mutex             `json:"-"`
+	walkFailures int64                  `json:"-"`
+	execution    sync.WaitGroup         `json:"-"`
+	suspending   int32                  `json:"-"`
+	filteredSize int64                  `json:"-"`
+	filteredNum  int64                  `json:"-"`
+	filteredDirs int64                  `json:"-"`
+	startedAt    time.Time              `json:"-"`
+	finishedAt   time.Time              `json:"-"`
+	log          *log.Logger            `json:"-"`
 }
 
 // Data stores the data needed to execute a recovery
@@ -37,5 +62,12 @@ type Data struct {
 	Deleted    bool            `json:"deleted"`
 	Version    int             `json:"version"`
 	Exclusions map[string]bool `json:"exclusions"`
+	Filters    *Filters        `json:"filters,omitempty"`
 	ClonerKey  string          `json:"-"`
+	// FilteredSize, FilteredFiles and FilteredFolders are what the exclusions and filters removed on the last
+	// precalculation. They are partial: excluded folders are never walked, so the files under them are not
+	// counted in FilteredFiles and their size is the one their folder metafile reports
+	FilteredSize    int64 `json:"filteredSize"`
+	FilteredFiles   int64 `json:"filteredFiles"`
+	FilteredFolders int64 `json:"filteredFolders"`
 }
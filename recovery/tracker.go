@@ -15,16 +15,16 @@ func (r *Recovery) autoTrack() {
 	for {
 		tick := 5 * time.Second
 		if r.Status == Running {
+			// Files are downloaded during both steps, so rates are measured all along
 			r.tracker.StartAutoPrint(tick)
-			if r.Step == Files {
-				r.tracker.StartAutoMeasure("size", tick)
-				r.tracker.StartAutoMeasure("completedSize", tick)
-			}
+			r.tracker.StartAutoMeasure("size", tick)
+			r.tracker.StartAutoMeasure("completedSize", tick)
 		} else {
 			r.tracker.StopAutoMeasure("size")
 			r.tracker.StopAutoMeasure("completedSize")
 			r.tracker.StopAutoPrint()
-			if r.Status == Done || r.Status == Canceled {
+			// Suspended recoveries go back to Queued and are run again with a new tracker
+			if r.Status != Paused {
 				break
 			}
 		}
@@ -37,6 +37,8 @@ func (r *Recovery) autoTrack() {
 func (r *Recovery) startTracker() error {
 	st := tracker.New()
 	r.tracker = st
+	r.startedAt = time.Now()
+	r.finishedAt = time.Time{}
 	r.tracker.AddGauge("files", "Files", 0)
 	r.tracker.AddGauge("blocks", "Blocks", 0)
 	r.tracker.AddGauge("size", "Size", 0)
@@ -44,6 +46,7 @@ func (r *Recovery) startTracker() error {
 	r.tracker.AddGauge("errors", "Errors", 0)
 	r.tracker.AddGauge("blocksBuffer", "", config.Data.BlocksBuffer)
 	r.tracker.AddGauge("metafiles", "Metafiles", 0)
+	r.tracker.AddGauge("cache", "Cache hits", 0)
 	r.tracker.InitSpdRate("size", 40)
 	r.tracker.InitSpdRate("completedSize", 40)
 	r.tracker.UnitsFunc("size", utils.B2H)
@@ -82,16 +85,20 @@ func (r *Recovery) printFunction() {
 	if err != nil {
 		log.Errorln(errors.New(op, err))
 	}
+	hc, ht, err := r.tracker.RawValues("cache")
+	if err != nil {
+		log.Errorln(errors.New(op, err))
+	}
 	// bfc, bft, err := r.tracker.RawValues("blocksBuffer")
 	// if err != nil {
 	// 	log.Errorln(errors.New(op, err))
 	// }
 	if r.Step == Metafiles {
-		log.Notice("[ Building Filetree ] Files: %d | Blocks: %d | Size: %s",
-			ft, bt, st)
+		log.Notice("[ Building Filetree ] Files: %d / %d | Blocks: %d / %d | Size: %s / %s | Errors: %d [ %sps ]",
+			fc, ft, bc, bt, sc, st, ec, rt)
 	} else if r.Step == Files {
-		log.Notice("[ Downloading Files ] Files: %d / %d | Blocks: %d / %d | Size: %s / %s | Errors: %d [ %sps | %s ]",
-			fc, ft, bc, bt, sc, st, ec, rt, eta /*, bfc, bft*/)
+		log.Notice("[ Downloading Files ] Files: %d / %d | Blocks: %d / %d | Size: %s / %s | Errors: %d | Cache hits: %d / %d [ %sps | %s ]",
+			fc, ft, bc, bt, sc, st, ec, hc, ht, rt, eta /*, bfc, bft*/)
 	}
 }
 
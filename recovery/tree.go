@@ -5,13 +5,18 @@ import (
 	"fmt"
 	"io/ioutil"
 	"net/http"
+	"os"
+	"path"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/clonercl/reposerver"
 	"github.com/morrocker/errors"
 	"github.com/morrocker/log"
 	"github.com/morrocker/recoveryserver/config"
+	"github.com/morrocker/recoveryserver/metrics"
+	"golang.org/x/text/unicode/norm"
 )
 
 // MetaTree stores the information about a single node on a metafile tree. It indicates its own metafile data and all children it contains
@@ -19,6 +24,7 @@ type MetaTree struct {
 	mf       *reposerver.Metafile
 	children []*MetaTree
 	path     string
+	rel      string
 	lock     sync.Mutex
 }
 
@@ -28,11 +34,16 @@ func newMetaTree(mf *reposerver.Metafile) *MetaTree {
 	return tree
 }
 
-// GetRecoveryTree takes in a recovery data and returns a metafileTree
-func (r *Recovery) GetRecoveryTree() (*MetaTree, error) {
+// GetRecoveryTree takes in a recovery data and returns a metafileTree. When fc is not nil, every file is
+// sent through it as soon as it is found, with its path set under dst and its parent folders already created
+func (r *Recovery) GetRecoveryTree(dst string, fc chan *MetaTree) (*MetaTree, error) {
 	r.log.Task("Starting metafile tree retrieval")
 
 	var wg sync.WaitGroup
+	atomic.StoreInt64(&r.walkFailures, 0)
+	atomic.StoreInt64(&r.filteredNum, 0)
+	atomic.StoreInt64(&r.filteredDirs, 0)
+	atomic.StoreInt64(&r.filteredSize, 0)
 
 	if len(r.Data.Exclusions) > 0 {
 		r.log.InfoV("List of metafiles (and their children) that will be excluded")
@@ -46,7 +57,7 @@ func (r *Recovery) GetRecoveryTree() (*MetaTree, error) {
 	r.log.TaskV("Starting %d metafile workers", config.Data.MetafileWorkers)
 	wg.Add(config.Data.MetafileWorkers)
 	for x := 0; x < config.Data.MetafileWorkers; x++ {
-		go r.getChildMetaTree(tc, &wg)
+		go r.getChildMetaTree(tc, fc, &wg)
 	}
 
 	mf, err := r.getMetafile()
@@ -55,6 +66,11 @@ func (r *Recovery) GetRecoveryTree() (*MetaTree, error) {
 	}
 
 	recoveryTree := newMetaTree(mf)
+	recoveryTree.path = dst
+	if mf.Type != reposerver.FolderType {
+		recoveryTree.path = path.Join(dst, mf.Name)
+		recoveryTree.rel = mf.Name
+	}
 	tc <- recoveryTree
 
 	wg.Wait()
@@ -67,7 +83,10 @@ func (r *Recovery) GetRecoveryTree() (*MetaTree, error) {
 	return recoveryTree, nil
 }
 
-func (r *Recovery) getChildMetaTree(tc chan *MetaTree, wg *sync.WaitGroup) {
+func (r *Recovery) getChildMetaTree(tc, fc chan *MetaTree, wg *sync.WaitGroup) {
+	metrics.Workers.WithLabelValues("metafile").Inc()
+	defer metrics.Workers.WithLabelValues("metafile").Dec()
+	busy := metrics.BusyWorkers.WithLabelValues("metafile")
 Outer:
 	for mt := range tc {
 		if r.flowGate() {
@@ -75,18 +94,42 @@ Outer:
 		}
 
 		if mt.mf.Type == reposerver.FolderType {
+			busy.Inc()
 			children, err := r.getChildren(mt.mf.ID)
+			busy.Dec()
 			if err != nil {
-				r.log.Error("Couldnt retrieve metafile: %s", errors.Extend("recoveries.getChildMetaTree()", err))
+				err = errors.Extend("recoveries.getChildMetaTree()", err)
+				r.log.Error("Couldnt retrieve metafile: %s", err)
+				atomic.AddInt64(&r.walkFailures, 1)
+				// Every file under the folder is lost, so the folder goes into the ledger in their place
+				if fc != nil {
+					r.increaseErrors()
+					r.recordFile(mt, fileOutcome{folder: true, err: err})
+				}
 				r.tracker.IncreaseCurr("metafiles")
 				continue
 			}
 
+			if fc != nil && r.journal.failed(mt.path) {
+				r.recordFile(mt, fileOutcome{folder: true})
+			}
 			for _, child := range children {
 				if r.flowGate() {
 					break Outer
 				}
 				childTree := newMetaTree(child)
+				childTree.path = path.Join(mt.path, child.Name)
+				childTree.rel = path.Join(mt.rel, child.Name)
+				if r.skipChild(childTree) {
+					r.tracker.IncreaseCurr("metafiles")
+					continue
+				}
+				if fc != nil && child.Type == reposerver.FolderType {
+					if err := os.MkdirAll(norm.NFC.String(childTree.path), outputDirMode()); err != nil {
+						r.increaseErrors()
+						r.log.Errorln(errors.New("recoveries.getChildMetaTree()", fmt.Sprintf("could not create path '%s': %v", childTree.path, err)))
+					}
+				}
 				mt.addChildren(childTree)
 				tc <- childTree
 			}
@@ -95,6 +138,9 @@ Outer:
 			continue
 		}
 		r.updateTrackerTotals(mt.mf.Size)
+		if fc != nil {
+			fc <- mt
+		}
 		r.tracker.IncreaseCurr("metafiles")
 		r.isDone(tc)
 	}
@@ -128,14 +174,17 @@ func (r *Recovery) getChildren(id string) ([]*reposerver.Metafile, error) {
 		req.Header.Add("Cloner_key", r.Data.ClonerKey)
 		resp, err := http.DefaultClient.Do(req)
 		if err != nil {
+			metrics.MetafileRequests.WithLabelValues(r.CloudName, "error").Inc()
 			errOut = errors.Extend(op, err)
 			continue
 		}
 
 		if resp.StatusCode != http.StatusOK {
+			metrics.MetafileRequests.WithLabelValues(r.CloudName, "error").Inc()
 			errOut = errors.NewSimple("Status not ok")
 			continue
 		}
+		metrics.MetafileRequests.WithLabelValues(r.CloudName, "ok").Inc()
 
 		body, err := ioutil.ReadAll(resp.Body)
 		if err != nil {
@@ -172,14 +221,17 @@ func (r *Recovery) getMetafile() (*reposerver.Metafile, error) {
 		req.Header.Add("Cloner_key", r.Data.ClonerKey)
 		resp, err := http.DefaultClient.Do(req)
 		if err != nil {
+			metrics.MetafileRequests.WithLabelValues(r.CloudName, "error").Inc()
 			errOut = errors.Extend(op, err)
 			continue
 		}
 
 		if resp.StatusCode != http.StatusOK {
+			metrics.MetafileRequests.WithLabelValues(r.CloudName, "error").Inc()
 			errOut = errors.NewSimple("Status not ok")
 			continue
 		}
+		metrics.MetafileRequests.WithLabelValues(r.CloudName, "ok").Inc()
 
 		body, err := ioutil.ReadAll(resp.Body)
 		if err != nil {
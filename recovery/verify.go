@@ -0,0 +1,95 @@
+package recovery
+
+import (
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/morrocker/errors"
+	"golang.org/x/text/unicode/norm"
+)
+
+// blockHashes maps each supported hash name to its constructor
+var blockHashes = map[string]func() hash.Hash{
+	"sha1":   sha1.New,
+	"sha256": sha256.New,
+	"sha512": sha512.New,
+}
+
+// hashByLength guesses the hash function used by a store from the length of the hex encoded hash
+var hashByLength = map[int]string{
+	sha1.Size * 2:   "sha1",
+	sha256.Size * 2: "sha256",
+	sha512.Size * 2: "sha512",
+}
+
+// checkableHash returns true if blockHash can be verified with algorithm
+func checkableHash(algorithm, blockHash string) bool {
+	if algorithm == "none" {
+		return true
+	}
+	_, ok := blockHashFunc(algorithm, blockHash)
+	return ok
+}
+
+// blockHashFunc returns the hash function algorithm names or, if empty, the one matching the hash length
+func blockHashFunc(algorithm, blockHash string) (func() hash.Hash, bool) {
+	if algorithm == "" {
+		algorithm = hashByLength[len(blockHash)]
+	}
+	newHash, ok := blockHashes[algorithm]
+	return newHash, ok
+}
+
+// verifyBlock checks a block's content against the hash it was requested with. algorithm may force a
+// hash function, "none" disables the check and an empty value picks one from the hash length. Hashes
+// that can't be matched to any function fail
+func verifyBlock(algorithm, blockHash string, content []byte) bool {
+	if algorithm == "none" {
+		return true
+	}
+	newHash, ok := blockHashFunc(algorithm, blockHash)
+	if !ok {
+		return false
+	}
+	h := newHash()
+	h.Write(content)
+	return hex.EncodeToString(h.Sum(nil)) == strings.ToLower(blockHash)
+}
+
+// verifyFile reads back a written file and checks each of its blocks, of the given lengths, against the
+// block list of its metafile. As the list itself was checked against Metafile.Hash, the file on disk is
+// matched as a whole
+func verifyFile(algorithm, filename string, blocks []string, lengths []int) error {
+	op := "recovery.verifyFile()"
+	if len(blocks) != len(lengths) {
+		return errors.New(op, fmt.Sprintf("%d blocks were written, expected %d", len(lengths), len(blocks)))
+	}
+	f, err := os.Open(norm.NFC.String(filename))
+	if err != nil {
+		return errors.New(op, err)
+	}
+	defer f.Close()
+	var buf []byte
+	for i, blockHash := range blocks {
+		if cap(buf) < lengths[i] {
+			buf = make([]byte, lengths[i])
+		}
+		if _, err := io.ReadFull(f, buf[:lengths[i]]); err != nil {
+			return errors.New(op, fmt.Sprintf("could not read block %d: %v", i, err))
+		}
+		if !verifyBlock(algorithm, blockHash, buf[:lengths[i]]) {
+			return errors.New(op, fmt.Sprintf("block %d does not match %s", i, blockHash))
+		}
+	}
+	if n, _ := f.Read(make([]byte, 1)); n > 0 {
+		return errors.New(op, "file is longer than its blocks")
+	}
+	return nil
+}
@@ -0,0 +1,179 @@
+package secrets
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base32"
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/morrocker/errors"
+	"golang.org/x/crypto/scrypt"
+)
+
+// Shared is the store used by the whole server. It is nil while no secrets file or key is configured
+var Shared *Store
+
+// Store keeps named secrets in a file, each one sealed with AES-GCM under a key derived from a master key
+// that never touches the disk
+type Store struct {
+	lock     sync.Mutex
+	filename string
+	aead     cipher.AEAD
+	salt     []byte
+	entries  map[string]string
+}
+
+// storeFile is the on disk representation of a Store
+type storeFile struct {
+	Salt    string            `json:"salt"`
+	Entries map[string]string `json:"entries"`
+}
+
+// Open loads the secrets file, creating a new one on the first Set if it doesn't exist. It fails if the
+// master key can't open the stored secrets
+func Open(filename, master string) (*Store, error) {
+	op := "secrets.Open()"
+	if master == "" {
+		return nil, errors.New(op, "Secrets master key is empty")
+	}
+	s := &Store{filename: filename, entries: make(map[string]string)}
+	data, err := ioutil.ReadFile(filename)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, errors.New(op, err)
+	}
+	if err == nil {
+		var sf storeFile
+		if err := json.Unmarshal(data, &sf); err != nil {
+			return nil, errors.New(op, err)
+		}
+		if s.salt, err = base64.StdEncoding.DecodeString(sf.Salt); err != nil {
+			return nil, errors.New(op, err)
+		}
+		if sf.Entries != nil {
+			s.entries = sf.Entries
+		}
+	} else {
+		s.salt = make([]byte, 16)
+		if _, err := rand.Read(s.salt); err != nil {
+			return nil, errors.New(op, err)
+		}
+	}
+
+	key, err := scrypt.Key([]byte(master), s.salt, 1<<15, 8, 1, 32)
+	if err != nil {
+		return nil, errors.New(op, err)
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, errors.New(op, err)
+	}
+	if s.aead, err = cipher.NewGCM(block); err != nil {
+		return nil, errors.New(op, err)
+	}
+	for name := range s.entries {
+		if _, _, err := s.get(name); err != nil {
+			return nil, errors.New(op, "Secrets master key does not match the secrets file")
+		}
+		break
+	}
+	return s, nil
+}
+
+// Set seals and stores a secret, replacing any previous one with the same name
+func (s *Store) Set(name, value string) error {
+	op := "secrets.Set()"
+	nonce := make([]byte, s.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return errors.New(op, err)
+	}
+	sealed := s.aead.Seal(nonce, nonce, []byte(value), []byte(name))
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.entries[name] = base64.StdEncoding.EncodeToString(sealed)
+	if err := s.save(); err != nil {
+		return errors.Extend(op, err)
+	}
+	return nil
+}
+
+// Get returns a stored secret. ok is false if there is no secret with that name
+func (s *Store) Get(name string) (value string, ok bool, err error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.get(name)
+}
+
+// get must be called holding lock
+func (s *Store) get(name string) (string, bool, error) {
+	op := "secrets.Get()"
+	encoded, ok := s.entries[name]
+	if !ok {
+		return "", false, nil
+	}
+	sealed, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return "", false, errors.New(op, err)
+	}
+	n := s.aead.NonceSize()
+	if len(sealed) < n {
+		return "", false, errors.New(op, "Secret "+name+" is corrupted")
+	}
+	value, err := s.aead.Open(nil, sealed[:n], sealed[n:], []byte(name))
+	if err != nil {
+		return "", false, errors.New(op, err)
+	}
+	return string(value), true, nil
+}
+
+// Delete removes a secret
+func (s *Store) Delete(name string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if _, ok := s.entries[name]; !ok {
+		return nil
+	}
+	delete(s.entries, name)
+	if err := s.save(); err != nil {
+		return errors.Extend("secrets.Delete()", err)
+	}
+	return nil
+}
+
+// save must be called holding lock
+func (s *Store) save() error {
+	op := "secrets.save()"
+	data, err := json.MarshalIndent(storeFile{Salt: base64.StdEncoding.EncodeToString(s.salt), Entries: s.entries}, "", "  ")
+	if err != nil {
+		return errors.New(op, err)
+	}
+	tmp := s.filename + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0600); err != nil {
+		return errors.New(op, err)
+	}
+	if err := os.Rename(tmp, s.filename); err != nil {
+		return errors.New(op, err)
+	}
+	return nil
+}
+
+// NewPassphrase returns a random passphrase of six dash separated groups of five characters, around 150
+// bits of entropy, avoiding characters easy to mistake when read aloud or typed
+func NewPassphrase() (string, error) {
+	buf := make([]byte, 20)
+	if _, err := rand.Read(buf); err != nil {
+		return "", errors.New("secrets.NewPassphrase()", err)
+	}
+	enc := strings.ToLower(base32.StdEncoding.EncodeToString(buf))[:30]
+	var groups []string
+	for i := 0; i < len(enc); i += 5 {
+		groups = append(groups, enc[i:i+5])
+	}
+	return strings.Join(groups, "-"), nil
+}
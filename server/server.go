@@ -1,11 +1,15 @@
 package server
 
 import (
+	"os"
+	"os/signal"
 	"sync"
+	"syscall"
 
 	"github.com/morrocker/errors"
 	"github.com/morrocker/log"
 	"github.com/morrocker/recoveryserver/config"
+	"github.com/morrocker/recoveryserver/director"
 	"github.com/morrocker/recoveryserver/service"
 )
 
@@ -23,15 +27,19 @@ func New() *Server {
 	return &server
 }
 
-// StartServer starts the recovry server and listens for requests
-func (s *Server) StartServer() {
+// StartServer starts the recovry server and listens for requests until it fails, receives SIGINT or
+// SIGTERM, or a shutdown is requested through the service. Returns the process exit code
+func (s *Server) StartServer() int {
 	op := "server.StartServer()"
-	errc := make(chan error)
-	done := make(chan interface{})
+	errc := make(chan error, 2)
+	sigc := make(chan os.Signal, 1)
+	signal.Notify(sigc, syscall.SIGINT, syscall.SIGTERM)
+	defer signal.Stop(sigc)
 
 	srvc, err := service.New(config.Data.HostAddr)
 	if err != nil {
 		log.Errorln(errors.Extend(op, err))
+		return 1
 	}
 	s.Service = srvc
 
@@ -43,11 +51,21 @@ func (s *Server) StartServer() {
 	}()
 
 	defer close(s.cancel)
+	code := 0
 	select {
 	case err := <-errc:
-		log.Errorln(err)
-	case <-done:
-		log.Task("Shutting down server")
+		log.Errorln(errors.Extend(op, err))
+		code = 1
+	case sig := <-sigc:
+		log.Info("Received %s. Shutting down server", sig)
+	case <-s.Service.Stopping():
+		log.Info("Shutting down server")
+	}
 
+	if err := s.Service.Shutdown(director.ShutdownTimeout()); err != nil {
+		log.Errorln(errors.Extend(op, err))
+		code = 1
 	}
+	log.Info("Server shut down")
+	return code
 }
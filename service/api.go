@@ -0,0 +1,474 @@
+package service
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"github.com/morrocker/errors"
+	"github.com/morrocker/log"
+	"github.com/morrocker/recoveryserver/config"
+	"github.com/morrocker/recoveryserver/pdf"
+	"github.com/morrocker/recoveryserver/recovery"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// apiError is the body of every failed /api/v1 request. Op is the handler operation, the message carries
+// the rest of the error chain
+type apiError struct {
+	Status  int    `json:"status"`
+	Message string `json:"message"`
+	Op      string `json:"op"`
+}
+
+// routesV1 registers the /api/v1 resource routes
+func (s *Service) routesV1(mux *gin.Engine) {
+	v1 := mux.Group("/api/v1")
+	viewer := v1.Group("", require(Viewer))
+	operator := v1.Group("", require(Operator))
+	admin := v1.Group("", require(Admin))
+
+	viewer.GET("/recoveries", s.listRecoveriesV1)
+	operator.POST("/recoveries", s.addRecoveryV1)
+	viewer.GET("/recoveries/:id", s.getRecoveryV1)
+	operator.POST("/recoveries/:id/queue", s.recoveryActionV1("service.queueRecoveryV1()", s.Director.QueueRecovery))
+	operator.POST("/recoveries/:id/start", s.recoveryActionV1("service.startRecoveryV1()", s.Director.StartRecovery))
+	operator.POST("/recoveries/:id/pause", s.recoveryActionV1("service.pauseRecoveryV1()", s.Director.PauseRecovery))
+	operator.POST("/recoveries/:id/cancel", s.recoveryActionV1("service.cancelRecoveryV1()", s.Director.CancelRecovery))
+	operator.POST("/recoveries/:id/precalculate", s.recoveryActionV1("service.precalculateV1()", s.Director.PreCalculate))
+	operator.DELETE("/recoveries/:id/cache", s.recoveryActionV1("service.invalidateCacheV1()", s.Director.InvalidateCache))
+	operator.PUT("/recoveries/:id/destination", s.setDestinationV1)
+	operator.PUT("/recoveries/:id/priority", s.setPriorityV1)
+	operator.PUT("/recoveries/:id/output", s.setArchiveV1)
+	admin.GET("/recoveries/:id/passphrase", s.getPassphraseV1)
+	operator.POST("/recoveries/:id/verify", s.verifyRecoveryV1)
+	viewer.GET("/recoveries/:id/errors", s.getRecoveryErrorsV1)
+	operator.POST("/recoveries/:id/retry", s.recoveryActionV1("service.retryFailuresV1()", s.Director.RetryFailures))
+	operator.PUT("/recoveries/:id/bandwidth", s.setRecoveryBandwidthV1)
+	operator.PUT("/recoveries/:id/missing-blocks", s.setMissingBlocksV1)
+	operator.PUT("/recoveries/:id/filters", s.setFiltersV1)
+	operator.DELETE("/recoveries/:id", s.removeRecoveryV1)
+	operator.POST("/recoveries/:id/archive", s.archiveRecoveryV1)
+	viewer.GET("/history", s.listHistoryV1)
+	viewer.GET("/history/:id", s.getHistoryV1)
+	viewer.GET("/events", s.events)
+	viewer.GET("/metrics", gin.WrapH(promhttp.Handler()))
+	operator.POST("/deliveries", s.writeDeliveryV1)
+	viewer.GET("/stores", s.getStoresV1)
+	viewer.GET("/bandwidth", s.getBandwidthV1)
+	operator.PUT("/bandwidth", s.setBandwidthV1)
+	viewer.GET("/devices", s.getDevices)
+	admin.POST("/devices/:serial/mount", s.deviceActionV1("service.mountDeviceV1()", s.Director.MountDisk))
+	admin.POST("/devices/:serial/unmount", s.deviceActionV1("service.unmountDeviceV1()", s.Director.UnmountDisk))
+	admin.POST("/shutdown", s.shutdownV1)
+}
+
+func (s *Service) listRecoveriesV1(c *gin.Context) {
+	c.JSON(http.StatusOK, s.Director.RecoveriesDetail())
+}
+
+func (s *Service) getRecoveryV1(c *gin.Context) {
+	op := "service.getRecoveryV1()"
+	id, ok := s.recoveryParam(c, op)
+	if !ok {
+		return
+	}
+	detail, err := s.Director.RecoveryDetail(id)
+	if err != nil {
+		apiFail(c, http.StatusInternalServerError, op, err)
+		return
+	}
+	c.JSON(http.StatusOK, detail)
+}
+
+func (s *Service) addRecoveryV1(c *gin.Context) {
+	op := "service.addRecoveryV1()"
+	var data recovery.Data
+	if !readJSON(c, op, &data) {
+		return
+	}
+	if s.Director.HasRecovery(data.ID) {
+		apiFail(c, http.StatusConflict, op, errors.New(op, fmt.Sprintf("Recovery #%d already exists", data.ID)))
+		return
+	}
+	if err := s.Director.AddRecovery(&data); err != nil {
+		apiFail(c, http.StatusBadRequest, op, err)
+		return
+	}
+	detail, err := s.Director.RecoveryDetail(data.ID)
+	if err != nil {
+		apiFail(c, http.StatusInternalServerError, op, err)
+		return
+	}
+	c.JSON(http.StatusCreated, detail)
+}
+
+// recoveryActionV1 returns a handler running a state change on the recovery from the path. A recovery
+// that can't make the change on its current state answers with a conflict
+func (s *Service) recoveryActionV1(op string, action func(int) error) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		id, ok := s.recoveryParam(c, op)
+		if !ok {
+			return
+		}
+		if err := action(id); err != nil {
+			apiFail(c, http.StatusConflict, op, err)
+			return
+		}
+		s.recoveryDetailV1(c, op, id)
+	}
+}
+
+func (s *Service) setDestinationV1(c *gin.Context) {
+	op := "service.setDestinationV1()"
+	id, ok := s.recoveryParam(c, op)
+	if !ok {
+		return
+	}
+	var body struct {
+		Destination string `json:"destination"`
+	}
+	if !readJSON(c, op, &body) {
+		return
+	}
+	if body.Destination == "" {
+		apiFail(c, http.StatusBadRequest, op, errors.New(op, "destination can't be empty"))
+		return
+	}
+	if err := s.Director.SetDestination(id, body.Destination); err != nil {
+		apiFail(c, http.StatusConflict, op, err)
+		return
+	}
+	s.recoveryDetailV1(c, op, id)
+}
+
+// setArchiveV1 sets the recovery archive output. An empty format writes a directory tree
+func (s *Service) setArchiveV1(c *gin.Context) {
+	op := "service.setArchiveV1()"
+	id, ok := s.recoveryParam(c, op)
+	if !ok {
+		return
+	}
+	var body recovery.ArchiveSettings
+	if !readJSON(c, op, &body) {
+		return
+	}
+	if err := s.Director.SetArchive(id, body); err != nil {
+		apiFail(c, http.StatusBadRequest, op, err)
+		return
+	}
+	s.recoveryDetailV1(c, op, id)
+}
+
+// verifyRecoveryV1 checks a recovery output against its manifest. The optional body path overrides the
+// recovery output path
+func (s *Service) verifyRecoveryV1(c *gin.Context) {
+	op := "service.verifyRecoveryV1()"
+	id, ok := s.recoveryParam(c, op)
+	if !ok {
+		return
+	}
+	var body struct {
+		Path string `json:"path"`
+	}
+	if c.Request.ContentLength != 0 && !readJSON(c, op, &body) {
+		return
+	}
+	v, err := s.Director.VerifyRecovery(id, body.Path)
+	if err != nil {
+		apiFail(c, http.StatusUnprocessableEntity, op, err)
+		return
+	}
+	c.JSON(http.StatusOK, v)
+}
+
+// getRecoveryErrorsV1 lists the files a recovery could not fully recover. With format=csv the list is
+// sent as a CSV download
+func (s *Service) getRecoveryErrorsV1(c *gin.Context) {
+	op := "service.getRecoveryErrorsV1()"
+	id, ok := s.recoveryParam(c, op)
+	if !ok {
+		return
+	}
+	errs, err := s.Director.RecoveryErrors(id)
+	if err != nil {
+		apiFail(c, http.StatusInternalServerError, op, err)
+		return
+	}
+	if c.Query("format") == "csv" {
+		writeErrorsCSV(c, id, errs)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"recovery": id, "count": len(errs), "errors": errs})
+}
+
+// getPassphraseV1 returns the passphrase of an encrypted recovery output. Every retrieval is logged
+func (s *Service) getPassphraseV1(c *gin.Context) {
+	op := "service.getPassphraseV1()"
+	id, ok := s.recoveryParam(c, op)
+	if !ok {
+		return
+	}
+	p, err := s.Director.Passphrase(id)
+	if err != nil {
+		apiFail(c, http.StatusNotFound, op, err)
+		return
+	}
+	log.Info("Passphrase of recovery #%d retrieved from %s", id, c.ClientIP())
+	c.Header("Cache-Control", "no-store")
+	c.JSON(http.StatusOK, gin.H{"id": id, "passphrase": p})
+}
+
+func (s *Service) setPriorityV1(c *gin.Context) {
+	op := "service.setPriorityV1()"
+	id, ok := s.recoveryParam(c, op)
+	if !ok {
+		return
+	}
+	var body struct {
+		Priority *int `json:"priority"`
+	}
+	if !readJSON(c, op, &body) {
+		return
+	}
+	if body.Priority == nil {
+		apiFail(c, http.StatusBadRequest, op, errors.New(op, "priority is missing"))
+		return
+	}
+	if err := s.Director.ChangePriority(id, *body.Priority); err != nil {
+		apiFail(c, http.StatusBadRequest, op, err)
+		return
+	}
+	s.recoveryDetailV1(c, op, id)
+}
+
+// setMissingBlocksV1 sets what a recovery does with files that have unavailable blocks. An empty policy
+// uses the server default
+func (s *Service) setMissingBlocksV1(c *gin.Context) {
+	op := "service.setMissingBlocksV1()"
+	id, ok := s.recoveryParam(c, op)
+	if !ok {
+		return
+	}
+	var body struct {
+		Policy string `json:"policy"`
+	}
+	if !readJSON(c, op, &body) {
+		return
+	}
+	if err := s.Director.SetMissingBlocks(id, body.Policy); err != nil {
+		apiFail(c, http.StatusBadRequest, op, err)
+		return
+	}
+	s.recoveryDetailV1(c, op, id)
+}
+
+// setFiltersV1 replaces the filters of a recovery. A null body removes them
+func (s *Service) setFiltersV1(c *gin.Context) {
+	op := "service.setFiltersV1()"
+	id, ok := s.recoveryParam(c, op)
+	if !ok {
+		return
+	}
+	var f *recovery.Filters
+	if !readJSON(c, op, &f) {
+		return
+	}
+	if err := s.Director.SetFilters(id, f); err != nil {
+		apiFail(c, http.StatusBadRequest, op, err)
+		return
+	}
+	s.recoveryDetailV1(c, op, id)
+}
+
+func (s *Service) setRecoveryBandwidthV1(c *gin.Context) {
+	op := "service.setRecoveryBandwidthV1()"
+	id, ok := s.recoveryParam(c, op)
+	if !ok {
+		return
+	}
+	var body struct {
+		Limit *int64 `json:"limit"`
+	}
+	if !readJSON(c, op, &body) {
+		return
+	}
+	if body.Limit == nil {
+		apiFail(c, http.StatusBadRequest, op, errors.New(op, "limit is missing"))
+		return
+	}
+	if err := s.Director.SetRecoveryBandwidth(id, *body.Limit); err != nil {
+		apiFail(c, http.StatusBadRequest, op, err)
+		return
+	}
+	s.recoveryDetailV1(c, op, id)
+}
+
+func (s *Service) getStoresV1(c *gin.Context) {
+	c.JSON(http.StatusOK, s.Director.Stores())
+}
+
+func (s *Service) getBandwidthV1(c *gin.Context) {
+	c.JSON(http.StatusOK, s.Director.Bandwidth())
+}
+
+// setBandwidthV1 replaces the global bandwidth limit. The schedule is only replaced when present on the body
+func (s *Service) setBandwidthV1(c *gin.Context) {
+	op := "service.setBandwidthV1()"
+	var body struct {
+		Limit    *int64                   `json:"limit"`
+		Schedule []config.BandwidthWindow `json:"schedule"`
+	}
+	if !readJSON(c, op, &body) {
+		return
+	}
+	if body.Limit == nil {
+		apiFail(c, http.StatusBadRequest, op, errors.New(op, "limit is missing"))
+		return
+	}
+	if err := s.Director.SetBandwidth(*body.Limit, body.Schedule); err != nil {
+		apiFail(c, http.StatusBadRequest, op, err)
+		return
+	}
+	c.JSON(http.StatusOK, s.Director.Bandwidth())
+}
+
+// removeRecoveryV1 removes a recovery. The purge query parameter also deletes its output and logs
+func (s *Service) removeRecoveryV1(c *gin.Context) {
+	op := "service.removeRecoveryV1()"
+	id, ok := s.recoveryParam(c, op)
+	if !ok {
+		return
+	}
+	purge, err := getQueryBool(c, "purge")
+	if err != nil {
+		apiFail(c, http.StatusBadRequest, op, err)
+		return
+	}
+	if err := s.Director.RemoveRecovery(id, purge); err != nil {
+		apiFail(c, http.StatusConflict, op, err)
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
+
+// archiveRecoveryV1 moves a finished recovery into the history. The purge query parameter also deletes its output and logs
+func (s *Service) archiveRecoveryV1(c *gin.Context) {
+	op := "service.archiveRecoveryV1()"
+	id, ok := s.recoveryParam(c, op)
+	if !ok {
+		return
+	}
+	purge, err := getQueryBool(c, "purge")
+	if err != nil {
+		apiFail(c, http.StatusBadRequest, op, err)
+		return
+	}
+	if err := s.Director.ArchiveRecovery(id, purge); err != nil {
+		apiFail(c, http.StatusConflict, op, err)
+		return
+	}
+	c.JSON(http.StatusOK, s.Director.History(id))
+}
+
+func (s *Service) listHistoryV1(c *gin.Context) {
+	c.JSON(http.StatusOK, s.Director.History(0))
+}
+
+func (s *Service) getHistoryV1(c *gin.Context) {
+	op := "service.getHistoryV1()"
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		apiFail(c, http.StatusBadRequest, op, errors.New(op, fmt.Sprintf("invalid recovery id %q", c.Param("id"))))
+		return
+	}
+	records := s.Director.History(id)
+	if len(records) == 0 {
+		apiFail(c, http.StatusNotFound, op, errors.New(op, fmt.Sprintf("Recovery %d has no archived records", id)))
+		return
+	}
+	c.JSON(http.StatusOK, records)
+}
+
+func (s *Service) writeDeliveryV1(c *gin.Context) {
+	op := "service.writeDeliveryV1()"
+	var delivery pdf.Delivery
+	if !readJSON(c, op, &delivery) {
+		return
+	}
+	out, err := s.Director.WriteDelivery(&delivery)
+	if err != nil {
+		apiFail(c, http.StatusInternalServerError, op, err)
+		return
+	}
+	c.JSON(http.StatusCreated, gin.H{"file": out})
+}
+
+// deviceActionV1 returns a handler running a disk operation on the device from the path
+func (s *Service) deviceActionV1(op string, action func(string) error) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		serial := c.Param("serial")
+		if !s.Director.HasDevice(serial) {
+			apiFail(c, http.StatusNotFound, op, errors.New(op, fmt.Sprintf("Device %s not found", serial)))
+			return
+		}
+		if err := action(serial); err != nil {
+			apiFail(c, http.StatusInternalServerError, op, err)
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"serial": serial})
+	}
+}
+
+func (s *Service) recoveryDetailV1(c *gin.Context, op string, id int) {
+	detail, err := s.Director.RecoveryDetail(id)
+	if err != nil {
+		apiFail(c, http.StatusInternalServerError, op, err)
+		return
+	}
+	c.JSON(http.StatusOK, detail)
+}
+
+// recoveryParam reads the recovery id from the path. It answers the request itself when the id is not
+// valid or no such recovery exists
+func (s *Service) recoveryParam(c *gin.Context, op string) (int, bool) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		apiFail(c, http.StatusBadRequest, op, errors.New(op, fmt.Sprintf("invalid recovery id %q", c.Param("id"))))
+		return 0, false
+	}
+	if !s.Director.HasRecovery(id) {
+		apiFail(c, http.StatusNotFound, op, errors.New(op, fmt.Sprintf("Recovery %d not found", id)))
+		return 0, false
+	}
+	return id, true
+}
+
+// readJSON decodes the request body into v. It answers the request itself when the body is not valid
+func readJSON(c *gin.Context, op string, v interface{}) bool {
+	bodyBytes, err := ioutil.ReadAll(c.Request.Body)
+	if err != nil {
+		apiFail(c, http.StatusBadRequest, op, errors.New(op, err))
+		return false
+	}
+	if err := json.Unmarshal(bodyBytes, v); err != nil {
+		apiFail(c, http.StatusBadRequest, op, errors.New(op, err))
+		return false
+	}
+	return true
+}
+
+func apiFail(c *gin.Context, status int, op string, err error) {
+	err = errors.Extend(op, err)
+	log.Errorln(err)
+	c.AbortWithStatusJSON(status, gin.H{"error": apiError{Status: status, Message: err.Error(), Op: op}})
+}
+
+func (s *Service) shutdownV1(c *gin.Context) {
+	log.Info("Shutdown requested by %s", c.ClientIP())
+	c.JSON(http.StatusAccepted, gin.H{"shutdown": true})
+	s.RequestShutdown()
+}
@@ -0,0 +1,184 @@
+package service
+
+import (
+	"bufio"
+	"crypto/subtle"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/morrocker/errors"
+	"github.com/morrocker/log"
+	"github.com/morrocker/recoveryserver/config"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Role sets which routes a caller may use. Each role includes every permission of the ones below it
+type Role int
+
+const (
+	// NoRole an unidentified caller
+	NoRole Role = iota
+	// Viewer may only read recoveries, devices, events and metrics
+	Viewer
+	// Operator may also add and manage recoveries and write deliveries
+	Operator
+	// Admin may also mount and unmount disks and shut the server down
+	Admin
+)
+
+const roleKey = "role"
+
+var roleNames = map[string]Role{
+	"viewer":   Viewer,
+	"operator": Operator,
+	"admin":    Admin,
+}
+
+// authenticator holds the API tokens and local users allowed to use the service
+type authenticator struct {
+	tokens map[string]Role
+	users  map[string]user
+}
+
+type user struct {
+	hash []byte
+	role Role
+}
+
+// newAuthenticator loads the API tokens from the config and the users from the configured users file
+func newAuthenticator(c config.Config) (*authenticator, error) {
+	op := "service.newAuthenticator()"
+	a := &authenticator{
+		tokens: make(map[string]Role),
+		users:  make(map[string]user),
+	}
+	for _, t := range c.APITokens {
+		role, ok := roleNames[strings.ToLower(t.Role)]
+		if !ok || t.Token == "" {
+			return nil, errors.New(op, fmt.Sprintf("API token %q has an empty token or unknown role %q", t.Name, t.Role))
+		}
+		a.tokens[t.Token] = role
+	}
+	if c.UsersFile != "" {
+		if err := a.loadUsers(c.UsersFile); err != nil {
+			return nil, errors.Extend(op, err)
+		}
+	}
+	if !a.enabled() {
+		log.Alert("No API tokens or users configured. The HTTP API only accepts requests from this machine")
+	}
+	return a, nil
+}
+
+// loadUsers reads a users file. Each line holds "name:bcrypt hash:role" and lines starting with # are ignored
+func (a *authenticator) loadUsers(filename string) error {
+	op := "service.loadUsers()"
+	f, err := os.Open(filename)
+	if err != nil {
+		return errors.New(op, err)
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Split(line, ":")
+		if len(fields) != 3 {
+			return errors.New(op, fmt.Sprintf("%s line %d must be name:hash:role", filename, n))
+		}
+		role, ok := roleNames[strings.ToLower(fields[2])]
+		if !ok {
+			return errors.New(op, fmt.Sprintf("%s line %d has unknown role %q", filename, n, fields[2]))
+		}
+		a.users[fields[0]] = user{hash: []byte(fields[1]), role: role}
+	}
+	if err := scanner.Err(); err != nil {
+		return errors.New(op, err)
+	}
+	log.InfoV("Loaded %d users from %s", len(a.users), filename)
+	return nil
+}
+
+func (a *authenticator) enabled() bool {
+	return len(a.tokens) > 0 || len(a.users) > 0
+}
+
+// identify returns the role of the caller from a bearer token or basic auth credentials
+func (a *authenticator) identify(req *http.Request) Role {
+	auth := req.Header.Get("Authorization")
+	if strings.HasPrefix(auth, "Bearer ") {
+		token := strings.TrimPrefix(auth, "Bearer ")
+		for t, role := range a.tokens {
+			if subtle.ConstantTimeCompare([]byte(t), []byte(token)) == 1 {
+				return role
+			}
+		}
+		return NoRole
+	}
+	name, password, ok := req.BasicAuth()
+	if !ok {
+		return NoRole
+	}
+	u, ok := a.users[name]
+	if !ok {
+		return NoRole
+	}
+	if err := bcrypt.CompareHashAndPassword(u.hash, []byte(password)); err != nil {
+		return NoRole
+	}
+	return u.role
+}
+
+// handleAuth identifies the caller and stores its role on the request context. Unidentified callers are
+// rejected. With no tokens nor users configured only requests from the loopback interface are accepted
+func (s *Service) handleAuth(c *gin.Context) {
+	if !s.auth.enabled() {
+		if !fromLoopback(c.Request) {
+			log.InfoV("Rejected request from %s to %s. No API tokens or users configured", c.Request.RemoteAddr, c.Request.URL.Path)
+			c.AbortWithStatus(http.StatusForbidden)
+			return
+		}
+		c.Set(roleKey, Admin)
+		c.Next()
+		return
+	}
+	role := s.auth.identify(c.Request)
+	if role == NoRole {
+		log.InfoV("Rejected unauthenticated request from %s to %s", c.ClientIP(), c.Request.URL.Path)
+		c.Header("WWW-Authenticate", `Basic realm="recoveryserver"`)
+		c.AbortWithStatus(http.StatusUnauthorized)
+		return
+	}
+	c.Set(roleKey, role)
+	c.Next()
+}
+
+// fromLoopback returns true if the request connection comes from this machine. Forwarding headers are
+// ignored, as anyone can set them
+func fromLoopback(req *http.Request) bool {
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		return false
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// require returns a middleware rejecting callers without at least the given role
+func require(role Role) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		v, _ := c.Get(roleKey)
+		if got, ok := v.(Role); !ok || got < role {
+			c.AbortWithStatus(http.StatusForbidden)
+			return
+		}
+		c.Next()
+	}
+}
@@ -0,0 +1,155 @@
+package service
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/morrocker/broadcast"
+	"github.com/morrocker/errors"
+	"github.com/morrocker/log"
+	"github.com/morrocker/recoveryserver/recovery"
+)
+
+// feed fans out the director's change notifications to every connected events client
+type feed struct {
+	once    sync.Once
+	lock    sync.Mutex
+	clients map[chan struct{}]bool
+}
+
+// stateEvent is sent every time a recovery changes its state or step
+type stateEvent struct {
+	ID    int    `json:"id"`
+	State string `json:"state"`
+	Step  string `json:"step"`
+}
+
+func (f *feed) start(l *broadcast.Listener) {
+	log.TaskV("Starting events feed")
+	go func() {
+		for range l.C {
+			f.notify()
+		}
+	}()
+}
+
+func (f *feed) subscribe() chan struct{} {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if f.clients == nil {
+		f.clients = make(map[chan struct{}]bool)
+	}
+	ch := make(chan struct{}, 1)
+	f.clients[ch] = true
+	return ch
+}
+
+func (f *feed) unsubscribe(ch chan struct{}) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	delete(f.clients, ch)
+}
+
+// notify wakes up every client without ever waiting for a slow one
+func (f *feed) notify() {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	for ch := range f.clients {
+		select {
+		case ch <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// events streams recoveries state changes and progress as Server-Sent Events. State events are sent
+// on connection and on every change, progress events every second for each running recovery
+func (s *Service) events(c *gin.Context) {
+	op := "service.events()"
+	s.feed.once.Do(func() {
+		s.feed.start(s.Director.Listen())
+	})
+	changes := s.feed.subscribe()
+	defer s.feed.unsubscribe(changes)
+
+	c.Writer.Header().Set("Content-Type", "text/event-stream")
+	c.Writer.Header().Set("Cache-Control", "no-cache")
+	c.Writer.Header().Set("Connection", "keep-alive")
+	c.Writer.WriteHeader(http.StatusOK)
+
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	sent := make(map[int]stateEvent)
+	if err := s.sendStates(c, sent); err != nil {
+		log.Errorln(errors.Extend(op, err))
+		return
+	}
+	for {
+		select {
+		case <-c.Request.Context().Done():
+			return
+		case <-s.Stopping():
+			return
+		case <-changes:
+			if err := s.sendStates(c, sent); err != nil {
+				log.ErrorlnV(errors.Extend(op, err))
+				return
+			}
+		case <-ticker.C:
+			for _, p := range s.Director.Progress() {
+				if p.State != recovery.Running.String() {
+					continue
+				}
+				if err := writeEvent(c, "progress", p); err != nil {
+					log.ErrorlnV(errors.Extend(op, err))
+					return
+				}
+			}
+		}
+	}
+}
+
+// sendStates sends a state event for every recovery whose state or step changed since the last call, and
+// a removed event for every recovery that is gone
+func (s *Service) sendStates(c *gin.Context, sent map[int]stateEvent) error {
+	op := "service.sendStates()"
+	current := make(map[int]bool)
+	for _, p := range s.Director.Progress() {
+		current[p.ID] = true
+		e := stateEvent{ID: p.ID, State: p.State, Step: p.Step}
+		if last, ok := sent[p.ID]; ok && last == e {
+			continue
+		}
+		if err := writeEvent(c, "state", e); err != nil {
+			return errors.Extend(op, err)
+		}
+		sent[p.ID] = e
+	}
+	for id := range sent {
+		if current[id] {
+			continue
+		}
+		if err := writeEvent(c, "removed", gin.H{"id": id}); err != nil {
+			return errors.Extend(op, err)
+		}
+		delete(sent, id)
+	}
+	return nil
+}
+
+func writeEvent(c *gin.Context, event string, v interface{}) error {
+	op := "service.writeEvent()"
+	data, err := json.Marshal(v)
+	if err != nil {
+		return errors.New(op, err)
+	}
+	if _, err := fmt.Fprintf(c.Writer, "event: %s\ndata: %s\n\n", event, data); err != nil {
+		return errors.New(op, err)
+	}
+	c.Writer.Flush()
+	return nil
+}
@@ -1,6 +1,7 @@
 package service
 
 import (
+	"bytes"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
@@ -36,11 +37,9 @@ func (s *Service) addRecovery(c *gin.Context) {
 }
 
 func (s *Service) getRecoveries(c *gin.Context) {
-	op := "service.queueRecovery()"
-
-	r := s.Director.Recoveries
+	op := "service.getRecoveries()"
 
-	bytes, err := json.Marshal(r)
+	bytes, err := s.Director.RecoveriesJSON()
 	if err != nil {
 		badRequest(c, op, err)
 		return
@@ -49,6 +48,26 @@ func (s *Service) getRecoveries(c *gin.Context) {
 	c.Data(http.StatusOK, "json", bytes)
 }
 
+func (s *Service) getRecovery(c *gin.Context) {
+	op := "service.getRecovery()"
+	id, err := getQueryInt(c, "id")
+	if err != nil {
+		badRequest(c, op, err)
+		return
+	}
+	detail, err := s.Director.RecoveryDetail(id)
+	if err != nil {
+		badRequest(c, op, err)
+		return
+	}
+	bytes, err := json.Marshal(detail)
+	if err != nil {
+		badRequest(c, op, err)
+		return
+	}
+	c.Data(http.StatusOK, "json", bytes)
+}
+
 func (s *Service) startRecovery(c *gin.Context) {
 	op := "service.startRecovery()"
 	id, err := getQueryInt(c, "id")
@@ -99,6 +118,76 @@ func (s *Service) queueRecovery(c *gin.Context) {
 	c.Data(http.StatusOK, "text", []byte("ok"))
 }
 
+func (s *Service) retryFailures(c *gin.Context) {
+	op := "service.retryFailures()"
+	id, err := getQueryInt(c, "id")
+	if err != nil {
+		badRequest(c, op, err)
+		return
+	}
+	if err := s.Director.RetryFailures(id); err != nil {
+		badRequest(c, op, err)
+		return
+	}
+	c.Data(http.StatusOK, "text", []byte("ok"))
+}
+
+func (s *Service) removeRecovery(c *gin.Context) {
+	op := "service.removeRecovery()"
+	id, err := getQueryInt(c, "id")
+	if err != nil {
+		badRequest(c, op, err)
+		return
+	}
+	purge, err := getQueryBool(c, "purge")
+	if err != nil {
+		badRequest(c, op, err)
+		return
+	}
+	if err := s.Director.RemoveRecovery(id, purge); err != nil {
+		badRequest(c, op, err)
+		return
+	}
+	c.Data(http.StatusOK, "text", []byte("ok"))
+}
+
+func (s *Service) archiveRecovery(c *gin.Context) {
+	op := "service.archiveRecovery()"
+	id, err := getQueryInt(c, "id")
+	if err != nil {
+		badRequest(c, op, err)
+		return
+	}
+	purge, err := getQueryBool(c, "purge")
+	if err != nil {
+		badRequest(c, op, err)
+		return
+	}
+	if err := s.Director.ArchiveRecovery(id, purge); err != nil {
+		badRequest(c, op, err)
+		return
+	}
+	c.Data(http.StatusOK, "text", []byte("ok"))
+}
+
+func (s *Service) getHistory(c *gin.Context) {
+	op := "service.getHistory()"
+	var id int
+	if _, ok := c.GetQuery("id"); ok {
+		var err error
+		if id, err = getQueryInt(c, "id"); err != nil {
+			badRequest(c, op, err)
+			return
+		}
+	}
+	bytes, err := json.Marshal(s.Director.History(id))
+	if err != nil {
+		badRequest(c, op, err)
+		return
+	}
+	c.Data(http.StatusOK, "json", bytes)
+}
+
 func (s *Service) precalculateSize(c *gin.Context) {
 	op := "service.queueRecovery()"
 	id, err := getQueryInt(c, "id")
@@ -113,6 +202,20 @@ func (s *Service) precalculateSize(c *gin.Context) {
 	c.Data(http.StatusOK, "text", []byte("ok"))
 }
 
+func (s *Service) invalidateCache(c *gin.Context) {
+	op := "service.invalidateCache()"
+	id, err := getQueryInt(c, "id")
+	if err != nil {
+		badRequest(c, op, err)
+		return
+	}
+	if err := s.Director.InvalidateCache(id); err != nil {
+		badRequest(c, op, err)
+		return
+	}
+	c.Data(http.StatusOK, "text", []byte("ok"))
+}
+
 func (s *Service) setOutput(c *gin.Context) {
 	op := "service.setOutput()"
 	id, err := getQueryInt(c, "id")
@@ -129,7 +232,108 @@ func (s *Service) setOutput(c *gin.Context) {
 		badRequest(c, op, err)
 		return
 	}
+	c.Data(http.StatusOK, "text", []byte("ok"))
+}
+
+// setArchive sets the recovery archive format, volume size in bytes and encryption. A missing format writes
+// a directory tree
+func (s *Service) setArchive(c *gin.Context) {
+	op := "service.setArchive()"
+	id, err := getQueryInt(c, "id")
+	if err != nil {
+		badRequest(c, op, err)
+		return
+	}
+	var volume int
+	if _, ok := c.GetQuery("volume"); ok {
+		if volume, err = getQueryInt(c, "volume"); err != nil {
+			badRequest(c, op, err)
+			return
+		}
+	}
+	encrypt, err := getQueryBool(c, "encrypt")
+	if err != nil {
+		badRequest(c, op, err)
+		return
+	}
+	a := recovery.ArchiveSettings{Format: c.Query("format"), VolumeSize: int64(volume), Encrypt: encrypt}
+	if err := s.Director.SetArchive(id, a); err != nil {
+		badRequest(c, op, err)
+		return
+	}
+	c.Data(http.StatusOK, "text", []byte("ok"))
+}
+
+func (s *Service) verifyRecovery(c *gin.Context) {
+	op := "service.verifyRecovery()"
+	id, err := getQueryInt(c, "id")
+	if err != nil {
+		badRequest(c, op, err)
+		return
+	}
+	v, err := s.Director.VerifyRecovery(id, c.Query("path"))
+	if err != nil {
+		badRequest(c, op, err)
+		return
+	}
+	bytes, err := json.Marshal(v)
+	if err != nil {
+		badRequest(c, op, err)
+		return
+	}
+	c.Data(http.StatusOK, "json", bytes)
+}
+
+func (s *Service) getRecoveryErrors(c *gin.Context) {
+	op := "service.getRecoveryErrors()"
+	id, err := getQueryInt(c, "id")
+	if err != nil {
+		badRequest(c, op, err)
+		return
+	}
+	errs, err := s.Director.RecoveryErrors(id)
+	if err != nil {
+		badRequest(c, op, err)
+		return
+	}
+	if c.Query("format") == "csv" {
+		writeErrorsCSV(c, id, errs)
+		return
+	}
+	bytes, err := json.Marshal(errs)
+	if err != nil {
+		badRequest(c, op, err)
+		return
+	}
+	c.Data(http.StatusOK, "json", bytes)
+}
 
+// writeErrorsCSV sends a recovery file errors as a CSV attachment
+func writeErrorsCSV(c *gin.Context, id int, errs []recovery.FileError) {
+	var buf bytes.Buffer
+	if err := recovery.WriteErrorsCSV(&buf, errs); err != nil {
+		badRequest(c, "service.writeErrorsCSV()", err)
+		return
+	}
+	c.Header("Content-Disposition", fmt.Sprintf("attachment; filename=\"recovery-%d-errors.csv\"", id))
+	c.Data(http.StatusOK, "text/csv", buf.Bytes())
+}
+
+func (s *Service) getPassphrase(c *gin.Context) {
+	op := "service.getPassphrase()"
+	id, err := getQueryInt(c, "id")
+	if err != nil {
+		badRequest(c, op, err)
+		return
+	}
+	p, err := s.Director.Passphrase(id)
+	if err != nil {
+		badRequest(c, op, err)
+		return
+	}
+	log.Info("Passphrase of recovery #%d retrieved from %s", id, c.ClientIP())
+	c.Header("Cache-Control", "no-store")
+	c.Data(http.StatusOK, "text", []byte(p))
 }
 
 func (s *Service) changePriority(c *gin.Context) {
@@ -152,6 +356,71 @@ func (s *Service) changePriority(c *gin.Context) {
 	c.Data(http.StatusOK, "text", []byte("ok"))
 }
 
+func (s *Service) setBandwidth(c *gin.Context) {
+	op := "service.setBandwidth()"
+	limit, err := getQueryInt(c, "limit")
+	if err != nil {
+		badRequest(c, op, err)
+		return
+	}
+	if id := c.Query("id"); id != "" {
+		n, err := getQueryInt(c, "id")
+		if err != nil {
+			badRequest(c, op, err)
+			return
+		}
+		if err := s.Director.SetRecoveryBandwidth(n, int64(limit)); err != nil {
+			badRequest(c, op, err)
+			return
+		}
+		c.Data(http.StatusOK, "text", []byte("ok"))
+		return
+	}
+	if err := s.Director.SetBandwidth(int64(limit), nil); err != nil {
+		badRequest(c, op, err)
+		return
+	}
+	c.Data(http.StatusOK, "text", []byte("ok"))
+}
+
+func (s *Service) setMissingBlocks(c *gin.Context) {
+	op := "service.setMissingBlocks()"
+	id, err := getQueryInt(c, "id")
+	if err != nil {
+		badRequest(c, op, err)
+		return
+	}
+	if err := s.Director.SetMissingBlocks(id, c.Query("policy")); err != nil {
+		badRequest(c, op, err)
+		return
+	}
+	c.Data(http.StatusOK, "text", []byte("ok"))
+}
+
+func (s *Service) setFilters(c *gin.Context) {
+	op := "service.setFilters()"
+	id, err := getQueryInt(c, "id")
+	if err != nil {
+		badRequest(c, op, err)
+		return
+	}
+	bodyBytes, err := ioutil.ReadAll(c.Request.Body)
+	if err != nil {
+		badRequest(c, op, err)
+		return
+	}
+	var f *recovery.Filters
+	if err := json.Unmarshal(bodyBytes, &f); err != nil {
+		badRequest(c, op, err)
+		return
+	}
+	if err := s.Director.SetFilters(id, f); err != nil {
+		badRequest(c, op, err)
+		return
+	}
+	c.Data(http.StatusOK, "text", []byte("ok"))
+}
+
 func (s *Service) writeDelivery(c *gin.Context) {
 	op := "service.generateDelivery()"
 	bodyBytes, err := ioutil.ReadAll(c.Request.Body)
@@ -175,8 +444,19 @@ func (s *Service) writeDelivery(c *gin.Context) {
 }
 
 func (s *Service) shutdown(c *gin.Context) {
-	log.Info("Shutting down server")
-	s.Close()
+	log.Info("Shutdown requested by %s", c.ClientIP())
+	c.Data(http.StatusAccepted, "text", []byte("Shutting down server"))
+	s.RequestShutdown()
+}
+
+func (s *Service) getStores(c *gin.Context) {
+	op := "service.getStores()"
+	bytes, err := json.Marshal(s.Director.Stores())
+	if err != nil {
+		badRequest(c, op, err)
+		return
+	}
+	c.Data(http.StatusOK, "json", bytes)
 }
 
 func (s *Service) getDevices(c *gin.Context) {
@@ -249,6 +529,19 @@ func getQueryInt(c *gin.Context, key string) (int, error) {
 	return v, nil
 }
 
+// getQueryBool returns false when the key is missing from the query
+func getQueryBool(c *gin.Context, key string) (bool, error) {
+	value, ok := c.GetQuery(key)
+	if !ok {
+		return false, nil
+	}
+	v, err := strconv.ParseBool(value)
+	if err != nil {
+		return false, errors.New("service.getQueryBool()", err)
+	}
+	return v, nil
+}
+
 // func (s *Service) test(c *gin.Context) {
 // 	op := "test.test"
 // 	id, err := getQueryInt(c, "Id")
@@ -1,12 +1,22 @@
 package service
 
-import "github.com/gin-gonic/gin"
+import (
+	"net/http"
 
-// handleCORS returns a middleware that adds CORS headers allowing everything
+	"github.com/gin-gonic/gin"
+	"github.com/morrocker/log"
+	"github.com/morrocker/recoveryserver/config"
+)
+
+// handleCORS returns a middleware that adds CORS headers. Only the origins listed on AllowedOrigins get them
 func (s *Service) handleCORS(c *gin.Context) {
 	c.Writer.Header().Set("Content-Type", "*")
-	c.Writer.Header().Set("Access-Control-Allow-Origin", "*")
+	if origin := allowedOrigin(c.GetHeader("Origin")); origin != "" {
+		c.Writer.Header().Set("Access-Control-Allow-Origin", origin)
+		c.Writer.Header().Set("Vary", "Origin")
+	}
 	c.Writer.Header().Set("Access-Control-Allow-Methods", "POST, GET, PUT, PATCH, DELETE, OPTIONS")
+	c.Writer.Header().Set("Access-Control-Allow-Headers", "Authorization, Content-Type")
 	if c.Request.Method == "OPTIONS" {
 		c.Writer.Header().Set("Access-Control-Max-Age", "600")
 		c.AbortWithStatus(204)
@@ -14,3 +24,33 @@ func (s *Service) handleCORS(c *gin.Context) {
 	}
 	c.Next()
 }
+
+// checkOrigin rejects the requests a browser sends on behalf of a page whose origin is not on AllowedOrigins,
+// so a page opened on a machine allowed to call the API can't use it. Requests without browser headers,
+// like those of scripts and other servers, are left to handleAuth
+func (s *Service) checkOrigin(c *gin.Context) {
+	origin := c.GetHeader("Origin")
+	if origin != "" && allowedOrigin(origin) != "" || origin == "" && !crossSite(c.GetHeader("Sec-Fetch-Site")) {
+		c.Next()
+		return
+	}
+	log.InfoV("Rejected request to %s from origin %q. It is not on AllowedOrigins", c.Request.URL.Path, origin)
+	c.AbortWithStatus(http.StatusForbidden)
+}
+
+// crossSite returns true if a Sec-Fetch-Site header value shows the request was made by another site page.
+// Browsers send it on links and embedded resources, which carry no Origin header
+func crossSite(site string) bool {
+	return site == "cross-site" || site == "same-site"
+}
+
+// allowedOrigin returns the value for the Access-Control-Allow-Origin header, or an empty string if the
+// origin is not allowed. No origin is allowed unless AllowedOrigins lists it, or lists "*"
+func allowedOrigin(origin string) string {
+	for _, o := range config.Data.AllowedOrigins {
+		if o == origin || o == "*" {
+			return origin
+		}
+	}
+	return ""
+}
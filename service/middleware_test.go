@@ -0,0 +1,50 @@
+package service
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/morrocker/recoveryserver/config"
+)
+
+func TestCheckOrigin(t *testing.T) {
+	gin.SetMode(gin.ReleaseMode)
+	s := &Service{}
+	mux := gin.New()
+	mux.Use(s.handleCORS)
+	mux.Use(s.checkOrigin)
+	mux.GET("/shutdown", func(c *gin.Context) { c.Status(http.StatusOK) })
+
+	defer func(origins []string) { config.Data.AllowedOrigins = origins }(config.Data.AllowedOrigins)
+	for _, tc := range []struct {
+		name    string
+		allowed []string
+		headers map[string]string
+		status  int
+		cors    string
+	}{
+		{"script", nil, nil, http.StatusOK, ""},
+		{"page without allow-list", nil, map[string]string{"Origin": "http://evil.example"}, http.StatusForbidden, ""},
+		{"link without allow-list", nil, map[string]string{"Sec-Fetch-Site": "cross-site"}, http.StatusForbidden, ""},
+		{"typed address", nil, map[string]string{"Sec-Fetch-Site": "none"}, http.StatusOK, ""},
+		{"listed page", []string{"http://ui.example"}, map[string]string{"Origin": "http://ui.example"}, http.StatusOK, "http://ui.example"},
+		{"unlisted page", []string{"http://ui.example"}, map[string]string{"Origin": "http://evil.example"}, http.StatusForbidden, ""},
+		{"any page", []string{"*"}, map[string]string{"Origin": "http://ui.example"}, http.StatusOK, "http://ui.example"},
+	} {
+		config.Data.AllowedOrigins = tc.allowed
+		req := httptest.NewRequest("GET", "/shutdown", nil)
+		for k, v := range tc.headers {
+			req.Header.Set(k, v)
+		}
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, req)
+		if w.Code != tc.status {
+			t.Errorf("%s: status %d, want %d", tc.name, w.Code, tc.status)
+		}
+		if got := w.Header().Get("Access-Control-Allow-Origin"); got != tc.cors {
+			t.Errorf("%s: Access-Control-Allow-Origin %q, want %q", tc.name, got, tc.cors)
+		}
+	}
+}
@@ -0,0 +1,27 @@
+package service
+
+import (
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/morrocker/recoveryserver/metrics"
+)
+
+// monitorHandler returns a middleware that measures every request latency per route. Streams such as
+// /events last as long as the client stays connected, so they are left out
+func (s *Service) monitorHandler() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		start := time.Now()
+		c.Next()
+		if strings.HasPrefix(c.Writer.Header().Get("Content-Type"), "text/event-stream") {
+			return
+		}
+		route := c.FullPath()
+		if route == "" {
+			route = "unknown"
+		}
+		metrics.RequestDuration.WithLabelValues(route, c.Request.Method, strconv.Itoa(c.Writer.Status())).Observe(time.Since(start).Seconds())
+	}
+}
@@ -1,6 +1,7 @@
 package service
 
 import (
+	"context"
 	"net"
 	"net/http"
 	"sync"
@@ -9,16 +10,23 @@ import (
 	"github.com/gin-gonic/gin"
 	"github.com/morrocker/errors"
 	"github.com/morrocker/log"
+	"github.com/morrocker/recoveryserver/config"
 	"github.com/morrocker/recoveryserver/director"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
 // Service contains all the information used to run a successful service.
 type Service struct {
 	Director director.Director
 	listener net.Listener
+	feed     feed
+	auth     *authenticator
 
 	mu sync.Mutex
 	s  *http.Server
+
+	stop     chan struct{}
+	stopOnce sync.Once
 }
 
 // tcpKeepAliveListener sets TCP keep-alive timeouts on accepted
@@ -31,12 +39,18 @@ type tcpKeepAliveListener struct {
 // New returns an instance of a service.
 func New(addr string) (*Service, error) {
 	log.Info("Serving Service on address %s", addr)
+	auth, err := newAuthenticator(config.Data)
+	if err != nil {
+		return nil, errors.Extend("service.New()", err)
+	}
 	ln, err := net.Listen("tcp", addr)
 	if err != nil {
 		return nil, err
 	}
 	return &Service{
 		listener: tcpKeepAliveListener{ln.(*net.TCPListener)},
+		auth:     auth,
+		stop:     make(chan struct{}),
 	}, nil
 }
 
@@ -52,27 +66,52 @@ func (s *Service) Handler() http.Handler {
 
 	// mux.Use(gin.Recovery())
 	mux.Use(s.handleCORS)
-	// mux.Use(s.handleAuth)
-	// mux.Use(s.monitorHandler())
-
-	mux.POST("/add", s.addRecovery)
-	mux.POST("/change_priority", s.changePriority)
-	mux.POST("/set_output", s.setOutput)
-	mux.GET("/precalculate", s.precalculateSize)
-	mux.GET("/recoveries", s.getRecoveries)
+	mux.Use(s.monitorHandler())
+	mux.Use(s.checkOrigin)
+	mux.Use(s.handleAuth)
+
+	viewer := mux.Group("", require(Viewer))
+	operator := mux.Group("", require(Operator))
+	admin := mux.Group("", require(Admin))
+
+	// The legacy routes keep their original methods. Browser requests from pages of origins not on
+	// AllowedOrigins, like links and embedded resources of another site, are rejected by checkOrigin
+	operator.POST("/add", s.addRecovery)
+	operator.POST("/change_priority", s.changePriority)
+	operator.POST("/set_output", s.setOutput)
+	operator.GET("/set_archive", s.setArchive)
+	operator.GET("/set_bandwidth", s.setBandwidth)
+	operator.GET("/set_missing_blocks", s.setMissingBlocks)
+	operator.POST("/set_filters", s.setFilters)
+	operator.GET("/precalculate", s.precalculateSize)
+	operator.GET("/invalidate_cache", s.invalidateCache)
+	viewer.GET("/recoveries", s.getRecoveries)
+	viewer.GET("/recovery", s.getRecovery)
+	viewer.GET("/events", s.events)
+	viewer.GET("/metrics", gin.WrapH(promhttp.Handler()))
 	// Recoveries run manipulation
-	mux.GET("/queue_recovery", s.queueRecovery)
-	mux.GET("/start_recovery", s.startRecovery)
-	mux.GET("/pause_recovery", s.pauseRecovery)
-	mux.GET("/cancel_recovery", s.cancelRecovery)
+	operator.GET("/queue_recovery", s.queueRecovery)
+	operator.GET("/start_recovery", s.startRecovery)
+	operator.GET("/pause_recovery", s.pauseRecovery)
+	operator.GET("/cancel_recovery", s.cancelRecovery)
+	operator.GET("/remove_recovery", s.removeRecovery)
+	operator.GET("/archive_recovery", s.archiveRecovery)
+	operator.GET("/retry_failures", s.retryFailures)
+	viewer.GET("/history", s.getHistory)
+	operator.GET("/verify_recovery", s.verifyRecovery)
+	viewer.GET("/recovery_errors", s.getRecoveryErrors)
 	// PDF generation
-	mux.GET("/generate_delivery", s.writeDelivery)
+	operator.GET("/generate_delivery", s.writeDelivery)
 	// Disk operations
-	mux.GET("/devices", s.getDevices)
-	mux.GET("/mount", s.mountDevice)
-	mux.GET("/unmount", s.unmountDevice)
+	viewer.GET("/devices", s.getDevices)
+	viewer.GET("/stores", s.getStores)
+	admin.GET("/mount", s.mountDevice)
+	admin.GET("/unmount", s.unmountDevice)
 	// Requests
-	mux.GET("/shutdown", s.shutdown)
+	admin.GET("/passphrase", s.getPassphrase)
+	admin.GET("/shutdown", s.shutdown)
+
+	s.routesV1(mux)
 
 	// mux.GET("/test", s.test)
 
@@ -107,6 +146,44 @@ func (s *Service) Close() error {
 	return s.s.Close()
 }
 
+// RequestShutdown asks the server owning the Service to shut down. It can be called any number of times
+func (s *Service) RequestShutdown() {
+	s.stopOnce.Do(func() {
+		close(s.stop)
+	})
+}
+
+// Stopping returns a channel that is closed once a shutdown has been requested
+func (s *Service) Stopping() <-chan struct{} {
+	return s.stop
+}
+
+// Shutdown stops accepting requests, waits up to timeout for the active ones to finish and then shuts the
+// Director down. Connections still open after timeout are closed.
+func (s *Service) Shutdown(timeout time.Duration) error {
+	op := "service.Shutdown()"
+	s.RequestShutdown()
+
+	s.mu.Lock()
+	srv := s.s
+	s.mu.Unlock()
+
+	var out error
+	if srv != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		defer cancel()
+		if err := srv.Shutdown(ctx); err != nil {
+			log.Alert("HTTP server did not shut down in %s. Closing remaining connections", timeout)
+			srv.Close()
+			out = errors.Extend(op, err)
+		}
+	}
+	if err := s.Director.Shutdown(); err != nil {
+		out = errors.Extend(op, err)
+	}
+	return out
+}
+
 // Serve accepts incoming connections Service's listener, creating a
 // new service goroutine for each. The service goroutines read requests and
 // then call s.Handler() to reply to them.
@@ -0,0 +1,71 @@
+package throttle
+
+import (
+	"sync"
+	"time"
+)
+
+// Global limits the block downloads of every recovery together
+var Global = New(0)
+
+// Limiter spaces out downloads so their throughput stays under a rate in bytes per second. A rate of
+// zero or less means unlimited
+type Limiter struct {
+	lock sync.Mutex
+	rate int64
+	next time.Time
+}
+
+// New returns a Limiter with the given rate in bytes per second
+func New(rate int64) *Limiter {
+	return &Limiter{rate: rate}
+}
+
+// SetRate changes the limiter rate in bytes per second. Zero or less removes the limit
+func (l *Limiter) SetRate(rate int64) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.rate = rate
+	l.next = time.Time{}
+}
+
+// Rate returns the current rate in bytes per second
+func (l *Limiter) Rate() int64 {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	return l.rate
+}
+
+// Wait accounts n downloaded bytes and blocks until the limiter throughput is back under its rate
+func (l *Limiter) Wait(n int) {
+	time.Sleep(l.Reserve(n))
+}
+
+// Reserve accounts n downloaded bytes and returns how long the caller must wait before downloading again
+func (l *Limiter) Reserve(n int) time.Duration {
+	if l == nil {
+		return 0
+	}
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if l.rate <= 0 {
+		return 0
+	}
+	now := time.Now()
+	if l.next.Before(now) {
+		l.next = now
+	}
+	l.next = l.next.Add(time.Duration(float64(n) / float64(l.rate) * float64(time.Second)))
+	return l.next.Sub(now)
+}
+
+// Wait accounts n downloaded bytes on every limiter and blocks until all of them are back under their rate
+func Wait(n int, limiters ...*Limiter) {
+	var delay time.Duration
+	for _, l := range limiters {
+		if d := l.Reserve(n); d > delay {
+			delay = d
+		}
+	}
+	time.Sleep(delay)
+}
@@ -0,0 +1,53 @@
+package throttle
+
+import (
+	"testing"
+	"time"
+)
+
+func TestReserveUnlimited(t *testing.T) {
+	var nilLimiter *Limiter
+	for _, l := range []*Limiter{nilLimiter, New(0), New(-1)} {
+		if d := l.Reserve(1 << 20); d != 0 {
+			t.Errorf("Reserve on an unlimited limiter = %s, want 0", d)
+		}
+	}
+}
+
+func TestReserveSpacesDownloads(t *testing.T) {
+	l := New(1000)
+	if d := l.Reserve(500); d < 450*time.Millisecond || d > 500*time.Millisecond {
+		t.Errorf("first Reserve(500) at 1000 B/s = %s, want about 500ms", d)
+	}
+	if d := l.Reserve(500); d < 950*time.Millisecond || d > time.Second {
+		t.Errorf("second Reserve(500) at 1000 B/s = %s, want about 1s", d)
+	}
+}
+
+func TestSetRateDropsReservations(t *testing.T) {
+	l := New(1000)
+	l.Reserve(10000)
+	l.SetRate(0)
+	if d := l.Reserve(10000); d != 0 {
+		t.Errorf("Reserve after removing the limit = %s, want 0", d)
+	}
+	if r := l.Rate(); r != 0 {
+		t.Errorf("Rate() = %d, want 0", r)
+	}
+	l.SetRate(1000)
+	if d := l.Reserve(100); d > 100*time.Millisecond {
+		t.Errorf("Reserve(100) after setting a new rate = %s, want at most 100ms", d)
+	}
+}
+
+func TestWaitUsesSlowestLimiter(t *testing.T) {
+	fast, slow := New(1<<30), New(20000)
+	start := time.Now()
+	Wait(1000, fast, nil, slow)
+	if elapsed := time.Since(start); elapsed < 40*time.Millisecond {
+		t.Errorf("Wait took %s, want at least the 50ms of the slowest limiter", elapsed)
+	}
+	if d := fast.Reserve(0); d > time.Millisecond {
+		t.Errorf("fast limiter was charged %s, want almost nothing", d)
+	}
+}
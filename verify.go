@@ -0,0 +1,56 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"github.com/morrocker/recoveryserver/recovery"
+)
+
+// verify checks a recovery output or delivery disk against the manifest at its root, without starting the
+// server. Usage: recoveryserver verify [-json] DIR. Returns 0 if the output matches its manifest
+func verify(args []string) int {
+	var asJSON bool
+	if len(args) > 0 && args[0] == "-json" {
+		asJSON = true
+		args = args[1:]
+	}
+	if len(args) != 1 {
+		fmt.Fprintln(os.Stderr, "usage: recoveryserver verify [-json] DIR")
+		return 2
+	}
+
+	v, err := recovery.VerifyManifest(args[0])
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+	if asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		enc.Encode(v)
+	} else {
+		for _, p := range v.Missing {
+			fmt.Println("MISSING  ", p)
+		}
+		for _, p := range v.Corrupted {
+			fmt.Printf("CORRUPTED %s: %s\n", p.Path, p.Reason)
+		}
+		for _, p := range v.Degraded {
+			fmt.Println("DEGRADED ", p)
+		}
+		for _, p := range v.Extra {
+			fmt.Println("EXTRA    ", p)
+		}
+		fmt.Printf("%d files in manifest: %d ok, %d missing, %d corrupted, %d degraded, %d extra\n",
+			v.Files, v.OK, len(v.Missing), len(v.Corrupted), len(v.Degraded), len(v.Extra))
+		if !v.TreeChecked {
+			fmt.Println("Metafile tree not checked: files that never reached the output are not listed")
+		}
+	}
+	if !v.Clean() {
+		return 1
+	}
+	return 0
+}